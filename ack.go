@@ -0,0 +1,300 @@
+package sphere
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// IAcknowledgement is implemented by channel models whose messages have to be acknowledged by the
+// clients. It returns the number of delivery attempts and the delay before the first retry, which
+// doubles with every retry, zero attempts disables acknowledgements.
+type IAcknowledgement interface {
+	Acknowledgement() (int, time.Duration)
+}
+
+// IUndelivered is implemented by channel models that observe the messages a connection never
+// acknowledged, either because every attempt failed or because they could not be kept for its user
+type IUndelivered interface {
+	Undelivered(*Connection, *Packet)
+}
+
+// pending is a message waiting for the acknowledgement of a connection
+type pending struct {
+	conn     *Connection
+	packet   *Packet
+	payload  *prepared
+	attempts int
+	// number of attempts allowed by the namespace
+	max     int
+	backoff time.Duration
+	// time of the next attempt
+	due time.Time
+	// order of the message among the messages of the connection
+	order uint64
+}
+
+// tracked holds the pending messages of a connection and the single timer redelivering them
+type tracked struct {
+	items map[string]*pending
+	timer *time.Timer
+	// time the timer fires at
+	due time.Time
+	// order given to the next message
+	next uint64
+}
+
+// acknowledgements keeps the pending messages of every connection and of the users that went away
+type acknowledgements struct {
+	sync.Mutex
+	// pending messages per connection id
+	conns map[string]*tracked
+	// messages left unacknowledged by the connections of a user, waiting for the user to come back
+	users map[string][]*pending
+}
+
+// acknowledgement returns the delivery attempts and the first retry delay of the namespace, zero
+// attempts when the messages are not acknowledged
+func (sphere *Sphere) acknowledgement(namespace string) (int, time.Duration) {
+	model, ok := sphere.models.Get(namespace)
+	if !ok {
+		return 0, 0
+	}
+	if acked, ok := model.(IAcknowledgement); ok {
+		return acked.Acknowledgement()
+	}
+	return 0, 0
+}
+
+// identify gives the packet a message id when the clients have to acknowledge it
+func (sphere *Sphere) identify(p *Packet) {
+	if attempts, _ := sphere.acknowledgement(p.Namespace); attempts > 0 && p.ID == "" {
+		p.ID = guid()
+	}
+}
+
+// deliver returns the handler of a channel whose messages are acknowledged, every connection gets
+// the message tracked until it acknowledges it
+func (sphere *Sphere) deliver(channel *Channel) func(*Packet) IError {
+	return func(p *Packet) IError {
+		// packets published by a node that does not track them are delivered once
+		if p.ID == "" {
+			return channel.deliver(p, channel.skip(p))
+		}
+		e := newEncodings(p)
+		skip := channel.skip(p)
+		for _, conn := range channel.Connections() {
+			if skip(conn) {
+				continue
+			}
+			pm, err := e.prepare(conn)
+			if err != nil {
+				return err
+			}
+			sphere.track(&pending{conn: conn, packet: p, payload: pm})
+		}
+		return nil
+	}
+}
+
+// track sends the message to the connection and schedules its redelivery, messages for a connection
+// that went away in the meantime are parked like the other messages of the connection
+func (sphere *Sphere) track(item *pending) {
+	attempts, backoff := sphere.acknowledgement(item.packet.Namespace)
+	if attempts <= 0 {
+		item.conn.enqueue(item.conn.codec.MessageType(), item.payload)
+		return
+	}
+	item.attempts, item.max, item.backoff = 1, attempts, backoff
+	item.due = time.Now().Add(backoff)
+	sphere.acks.Lock()
+	select {
+	case <-item.conn.done:
+		failed := sphere.stash(item.conn.UserID(), []*pending{item})
+		sphere.acks.Unlock()
+		for _, item := range failed {
+			sphere.undelivered(item)
+		}
+		return
+	default:
+	}
+	if sphere.acks.conns == nil {
+		sphere.acks.conns = map[string]*tracked{}
+	}
+	t, ok := sphere.acks.conns[item.conn.id]
+	if !ok {
+		t = &tracked{items: map[string]*pending{}}
+		sphere.acks.conns[item.conn.id] = t
+	}
+	t.next++
+	item.order = t.next
+	t.items[item.packet.ID] = item
+	sphere.schedule(item.conn, t)
+	sphere.acks.Unlock()
+	// a full queue is not a failure, the message is sent again once the delay expires
+	item.conn.enqueue(item.conn.codec.MessageType(), item.payload)
+}
+
+// schedule sets the timer of the connection to the next due message, the acks lock is held
+func (sphere *Sphere) schedule(conn *Connection, t *tracked) {
+	var due time.Time
+	for _, item := range t.items {
+		if due.IsZero() || item.due.Before(due) {
+			due = item.due
+		}
+	}
+	if due.IsZero() || (t.timer != nil && !t.due.IsZero() && !due.Before(t.due)) {
+		return
+	}
+	t.due = due
+	if t.timer == nil {
+		t.timer = time.AfterFunc(time.Until(due), func() {
+			sphere.retry(conn)
+		})
+		return
+	}
+	t.timer.Reset(time.Until(due))
+}
+
+// retry sends the due messages of the connection again or gives up on the messages that had every
+// attempt
+func (sphere *Sphere) retry(conn *Connection) {
+	var resend, failed []*pending
+	now := time.Now()
+	sphere.acks.Lock()
+	t, ok := sphere.acks.conns[conn.id]
+	if !ok {
+		// acknowledged or parked in the meantime
+		sphere.acks.Unlock()
+		return
+	}
+	t.due = time.Time{}
+	for id, item := range t.items {
+		if item.due.After(now) {
+			continue
+		}
+		if item.attempts >= item.max {
+			delete(t.items, id)
+			failed = append(failed, item)
+			continue
+		}
+		item.attempts++
+		item.backoff *= 2
+		item.due = now.Add(item.backoff)
+		resend = append(resend, item)
+	}
+	if len(t.items) == 0 {
+		delete(sphere.acks.conns, conn.id)
+	} else {
+		sphere.schedule(conn, t)
+	}
+	sphere.acks.Unlock()
+	// messages are sent again in the order they were sent first
+	sort.Slice(resend, func(i, j int) bool { return resend[i].order < resend[j].order })
+	for _, item := range resend {
+		conn.enqueue(conn.codec.MessageType(), item.payload)
+	}
+	for _, item := range failed {
+		sphere.undelivered(item)
+	}
+}
+
+// ack removes the acknowledged message from the pending messages of the connection
+func (sphere *Sphere) ack(p *Packet, conn *Connection) IError {
+	if p.ID == "" {
+		return ErrBadScheme
+	}
+	sphere.acks.Lock()
+	defer sphere.acks.Unlock()
+	if t, ok := sphere.acks.conns[conn.id]; ok {
+		delete(t.items, p.ID)
+		if len(t.items) == 0 {
+			t.timer.Stop()
+			delete(sphere.acks.conns, conn.id)
+		}
+	}
+	return nil
+}
+
+// park keeps the pending messages of a closed connection for its user, so that they are sent again
+// when the user subscribes to the channel from a new connection. Messages of anonymous connections
+// and messages that do not fit in the send queue size of the user are undelivered.
+func (sphere *Sphere) park(conn *Connection) {
+	var items []*pending
+	sphere.acks.Lock()
+	if t, ok := sphere.acks.conns[conn.id]; ok {
+		t.timer.Stop()
+		for _, item := range t.items {
+			items = append(items, item)
+		}
+		delete(sphere.acks.conns, conn.id)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].order < items[j].order })
+	failed := sphere.stash(conn.UserID(), items)
+	sphere.acks.Unlock()
+	for _, item := range failed {
+		sphere.undelivered(item)
+	}
+}
+
+// stash keeps the messages for the user and returns the messages that cannot be kept, the acks
+// lock is held
+func (sphere *Sphere) stash(user string, items []*pending) []*pending {
+	if user == "" || len(items) == 0 {
+		return items
+	}
+	if sphere.acks.users == nil {
+		sphere.acks.users = map[string][]*pending{}
+	}
+	list := append(sphere.acks.users[user], items...)
+	var failed []*pending
+	if len(list) > sphere.option.SendQueueSize {
+		n := len(list) - sphere.option.SendQueueSize
+		failed = list[:n]
+		list = append([]*pending{}, list[n:]...)
+	}
+	sphere.acks.users[user] = list
+	return failed
+}
+
+// redeliver sends the parked messages of the channel to a new connection of their user
+func (sphere *Sphere) redeliver(channel *Channel, conn *Connection) {
+	user := conn.UserID()
+	if user == "" {
+		return
+	}
+	var list []*pending
+	sphere.acks.Lock()
+	kept := sphere.acks.users[user][:0]
+	for _, item := range sphere.acks.users[user] {
+		if channel.Match(item.packet.Namespace, item.packet.Room) {
+			list = append(list, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == 0 {
+		delete(sphere.acks.users, user)
+	} else {
+		sphere.acks.users[user] = kept
+	}
+	sphere.acks.Unlock()
+	// the new connection may speak another codec
+	for _, item := range list {
+		pm, err := newEncodings(item.packet).prepare(conn)
+		if err != nil {
+			LogError(err)
+			continue
+		}
+		sphere.track(&pending{conn: conn, packet: item.packet, payload: pm})
+	}
+}
+
+// undelivered notifies the channel model about a message that was never acknowledged
+func (sphere *Sphere) undelivered(item *pending) {
+	if model, ok := sphere.models.Get(item.packet.Namespace); ok {
+		if observer, ok := model.(IUndelivered); ok {
+			observer.Undelivered(item.conn, item.packet)
+		}
+	}
+}
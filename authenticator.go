@@ -0,0 +1,39 @@
+package sphere
+
+import "net/http"
+
+// IAuthenticator authenticates the handshake request before the websocket upgrade. The returned
+// identity is attached to the connection, headers added to the response header are sent with the
+// upgrade response (cookies, selected subprotocol) or with the rejection.
+type IAuthenticator interface {
+	Authenticate(*http.Request, http.Header) (interface{}, IError)
+}
+
+// AuthenticatorFunc lets an ordinary function be used as IAuthenticator
+type AuthenticatorFunc func(*http.Request, http.Header) (interface{}, IError)
+
+// Authenticate calls fn(r, header)
+func (fn AuthenticatorFunc) Authenticate(r *http.Request, header http.Header) (interface{}, IError) {
+	return fn(r, header)
+}
+
+// authenticate runs the authenticator and writes the rejection response when it fails
+func (sphere *Sphere) authenticate(w http.ResponseWriter, r *http.Request) (interface{}, http.Header, IError) {
+	header := http.Header{}
+	if sphere.authenticator == nil {
+		return nil, header, nil
+	}
+	identity, err := sphere.authenticator.Authenticate(r, header)
+	if err == nil {
+		return identity, header, nil
+	}
+	status := http.StatusUnauthorized
+	if e, ok := err.(*HandshakeError); ok {
+		status = e.Status
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	http.Error(w, http.StatusText(status), status)
+	return nil, nil, err
+}
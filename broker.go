@@ -2,6 +2,7 @@ package sphere
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/streamrail/concurrent-map"
 )
@@ -19,20 +20,29 @@ const (
 
 // IBroker represents Broker instance
 type IBroker interface {
-	ID() string                            // => Broker ID
-	ChannelName(string, string) string     // => Broker generate channel name with namespace and channel
-	IsSubscribed(string, string) bool      // => Broker channel subscribe state
-	OnSubscribe(*Channel, chan<- IError)   // => Broker OnSubscribe
-	OnUnsubscribe(*Channel, chan<- IError) // => Broker OnUnsubscribe
-	OnPublish(*Channel, *Packet) error     // => Broker OnPublish
-	OnMessage(*Channel, *Packet) error     // => Broker OnMessage
+	ID() string                                     // => Broker ID
+	ChannelName(string, string) string              // => Broker generate channel name with namespace and channel
+	IsSubscribed(string, string) bool               // => Broker channel subscribe state
+	OnSubscribe(*Channel, chan<- IError)            // => Broker OnSubscribe
+	OnUnsubscribe(*Channel, chan<- IError)          // => Broker OnUnsubscribe
+	OnPublish(*Channel, *Packet) error              // => Broker OnPublish
+	OnMessage(*Channel, *Packet) error              // => Broker OnMessage
+	OnConnect(*Connection) error                    // => Broker registers the connection as owned by this broker
+	OnDisconnect(*Connection) error                 // => Broker unregisters the connection
+	Owner(string) (string, error)                   // => Broker ID owning the connection with the given ID
+	OnJoin(*Channel, string, *Member) (int, error)  // => Broker registers the presence member of a connection, returns the connections of the member on every node
+	OnLeave(*Channel, string, *Member) (int, error) // => Broker removes the presence member of a connection, returns the connections of the member left on every node
+	Members(*Channel) ([]*Member, error)            // => Broker presence members of the channel on every node
 }
 
 // ExtendBroker creates a broker instance
 func ExtendBroker() *Broker {
 	return &Broker{
-		id:    guid.String(),
-		store: cmap.New(),
+		id:       guid(),
+		store:    cmap.New(),
+		owners:   cmap.New(),
+		codec:    &JSONCodec{},
+		presence: &presenceCounts{counts: map[string]map[string]int{}},
 	}
 }
 
@@ -42,6 +52,38 @@ type Broker struct {
 	id string
 	// Channel store
 	store cmap.ConcurrentMap
+	// Connection owners
+	owners cmap.ConcurrentMap
+	// Codec of the packets exchanged between nodes
+	codec ICodec
+	// Connections of the presence members
+	presence *presenceCounts
+}
+
+// presenceCounts counts the connections of the presence members per channel
+type presenceCounts struct {
+	sync.Mutex
+	counts map[string]map[string]int
+}
+
+// add changes the connections of the member and returns them
+func (pc *presenceCounts) add(channel string, id string, n int) int {
+	pc.Lock()
+	defer pc.Unlock()
+	members, ok := pc.counts[channel]
+	if !ok {
+		members = map[string]int{}
+		pc.counts[channel] = members
+	}
+	members[id] += n
+	count := members[id]
+	if count <= 0 {
+		delete(members, id)
+		if len(members) == 0 {
+			delete(pc.counts, channel)
+		}
+	}
+	return count
 }
 
 // ID returns the unique id for the broker
@@ -54,6 +96,30 @@ func (broker *Broker) Store() cmap.ConcurrentMap {
 	return broker.store
 }
 
+// Codec returns the codec of the packets exchanged between nodes
+func (broker *Broker) Codec() ICodec {
+	return broker.codec
+}
+
+// SetCodec changes the codec of the packets exchanged between nodes, json by default. It is
+// independent of the codecs spoken by the clients. Every node understands json and msgpack whatever
+// its codec, so a cluster switches to msgpack once every node runs a version that understands it.
+func (broker *Broker) SetCodec(codec ICodec) {
+	broker.codec = codec
+}
+
+// decode parses a packet published by a node, json and msgpack are understood whatever the codec of
+// the broker so that the nodes of a cluster can switch codec one at a time
+func (broker *Broker) decode(data []byte) (*Packet, error) {
+	if len(data) > 0 && data[0] == '{' {
+		return ParsePacket(data)
+	}
+	if _, ok := broker.codec.(*JSONCodec); ok {
+		return (&MsgPackCodec{}).Unmarshal(data)
+	}
+	return broker.codec.Unmarshal(data)
+}
+
 // ChannelName returns channel name with provided namespace and room name
 func (broker *Broker) ChannelName(namespace string, room string) string {
 	return namespace + ":" + room
@@ -83,3 +149,44 @@ func (broker *Broker) OnPublish(channel *Channel, data *Packet) error {
 func (broker *Broker) OnMessage(channel *Channel, data *Packet) error {
 	return errors.New(brokerErrorOverrideOnMessage)
 }
+
+// OnConnect when websocket connection is accepted by the current broker
+func (broker *Broker) OnConnect(conn *Connection) error {
+	broker.owners.Set(conn.id, broker.id)
+	return nil
+}
+
+// OnDisconnect when websocket connection is closed on the current broker
+func (broker *Broker) OnDisconnect(conn *Connection) error {
+	broker.owners.Remove(conn.id)
+	return nil
+}
+
+// Owner returns the id of the broker owning the connection, the default implementation only knows
+// about connections of the current broker
+func (broker *Broker) Owner(id string) (string, error) {
+	if tmp, ok := broker.owners.Get(id); ok {
+		if owner, ok := tmp.(string); ok {
+			return owner, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// OnJoin when a presence member subscribes to a channel of the current broker, the default
+// implementation only counts the connections of the current broker
+func (broker *Broker) OnJoin(channel *Channel, id string, member *Member) (int, error) {
+	return broker.presence.add(channel.Name(), member.ID, 1), nil
+}
+
+// OnLeave when a presence member leaves a channel of the current broker, the default implementation
+// only counts the connections of the current broker
+func (broker *Broker) OnLeave(channel *Channel, id string, member *Member) (int, error) {
+	return broker.presence.add(channel.Name(), member.ID, -1), nil
+}
+
+// Members returns the presence members of the channel, the default implementation only knows
+// about members of the current broker
+func (broker *Broker) Members(channel *Channel) ([]*Member, error) {
+	return channel.Members(), nil
+}
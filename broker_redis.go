@@ -1,10 +1,24 @@
 package sphere
 
 import (
-	"github.com/gorilla/websocket"
+	"encoding/json"
+
 	redis "gopkg.in/redis.v3"
 )
 
+const (
+	// redisConnections is the hash of connection ids to the id of the owning broker
+	redisConnections = "sphere:connections"
+	// redisPresence is the prefix of the hashes of connection ids to presence members
+	redisPresence = "sphere:presence:"
+	// redisPresenceCounts is the prefix of the hashes of member ids to their number of connections
+	redisPresenceCounts = "sphere:presence-counts:"
+	// redisLeave decrements the connections of a member and removes the member without connections
+	redisLeave = `local n = redis.call('HINCRBY', KEYS[1], ARGV[1], -1)
+if n <= 0 then redis.call('HDEL', KEYS[1], ARGV[1]) end
+return n`
+)
+
 var (
 	roption = redis.Options{
 		Addr:     "localhost:6379",
@@ -35,19 +49,34 @@ func (broker *RedisBroker) OnSubscribe(channel *Channel, done chan<- IError) {
 			done <- nil
 			return
 		}
-		// creates subscribe pubsub
-		pubsub, err := subclient.Subscribe(channel.Name())
-		if err == nil {
-			broker.store.Set(channel.Name(), pubsub)
+		// creates subscribe pubsub, patterns are subscribed with a glob
+		var pubsub *redis.PubSub
+		var err error
+		if channel.IsPattern() {
+			pubsub, err = subclient.PSubscribe(globPattern(channel.namespace, channel.room))
+		} else {
+			pubsub, err = subclient.Subscribe(channel.Name())
+		}
+		if err != nil {
+			done <- err
+			return
 		}
-		done <- err
+		broker.store.Set(channel.Name(), pubsub)
+		done <- nil
 		for {
 			msg, err := pubsub.ReceiveMessage()
 			if err != nil {
-				done <- err
+				// pubsub has been closed by OnUnsubscribe
 				return
 			}
-			if p, err := ParsePacket([]byte(msg.Payload)); err == nil {
+			p, err := broker.decode([]byte(msg.Payload))
+			if err != nil {
+				// a node publishing with a codec this node does not speak
+				LogError(err)
+				continue
+			}
+			// a glob matches a wider set of rooms than the pattern
+			if !channel.IsPattern() || channel.Match(p.Namespace, p.Room) {
 				broker.OnMessage(channel, p)
 			}
 		}
@@ -74,11 +103,16 @@ func (broker *RedisBroker) OnUnsubscribe(channel *Channel, done chan<- IError) {
 func (broker *RedisBroker) OnPublish(channel *Channel, data *Packet) error {
 	c := make(chan error)
 	go func() {
-		if str := data.String(); str != "" {
-			res := pubclient.Publish(channel.Name(), str)
+		if payload, err := broker.codec.Marshal(data); err == nil {
+			res := pubclient.Publish(channel.Name(), string(payload))
+			if res.Err() == nil && channel.direct() && res.Val() == 0 {
+				// no node owns the connection or the user
+				c <- ErrNotFound
+				return
+			}
 			c <- res.Err()
 		} else {
-			c <- nil
+			c <- err
 		}
 	}()
 	return <-c
@@ -88,10 +122,70 @@ func (broker *RedisBroker) OnPublish(channel *Channel, data *Packet) error {
 func (broker *RedisBroker) OnMessage(channel *Channel, data *Packet) error {
 	c := make(chan error)
 	go func() {
-		if json, err := data.ToJSON(); err == nil {
-			channel.Emit(websocket.TextMessage, json, nil)
-		}
-		c <- nil
+		c <- channel.Deliver(data)
 	}()
 	return <-c
 }
+
+// OnConnect registers the connection owner in redis
+func (broker *RedisBroker) OnConnect(conn *Connection) error {
+	return pubclient.HSet(redisConnections, conn.id, broker.id).Err()
+}
+
+// OnDisconnect removes the connection owner from redis
+func (broker *RedisBroker) OnDisconnect(conn *Connection) error {
+	return pubclient.HDel(redisConnections, conn.id).Err()
+}
+
+// Owner returns the id of the broker owning the connection
+func (broker *RedisBroker) Owner(id string) (string, error) {
+	owner, err := pubclient.HGet(redisConnections, id).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return owner, err
+}
+
+// OnJoin registers the presence member in redis and counts its connections on every node
+func (broker *RedisBroker) OnJoin(channel *Channel, id string, member *Member) (int, error) {
+	data, err := json.Marshal(member)
+	if err != nil {
+		return 0, err
+	}
+	if err := pubclient.HSet(redisPresence+channel.Name(), id, string(data)).Err(); err != nil {
+		return 0, err
+	}
+	n, err := pubclient.HIncrBy(redisPresenceCounts+channel.Name(), member.ID, 1).Result()
+	return int(n), err
+}
+
+// OnLeave removes the presence member from redis, the count is decremented atomically so that the
+// last connection of the member is noticed by a single node
+func (broker *RedisBroker) OnLeave(channel *Channel, id string, member *Member) (int, error) {
+	if err := pubclient.HDel(redisPresence+channel.Name(), id).Err(); err != nil {
+		return 0, err
+	}
+	res, err := pubclient.Eval(redisLeave, []string{redisPresenceCounts + channel.Name()}, []string{member.ID}).Result()
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.(int64)
+	return int(n), nil
+}
+
+// Members returns the presence members of the channel on every node
+func (broker *RedisBroker) Members(channel *Channel) ([]*Member, error) {
+	res, err := pubclient.HGetAll(redisPresence + channel.Name()).Result()
+	if err != nil {
+		return nil, err
+	}
+	// result is a flat list of field and value pairs
+	members := make([]*Member, 0, len(res)/2)
+	for i := 1; i < len(res); i += 2 {
+		var member *Member
+		if err := json.Unmarshal([]byte(res[i]), &member); err == nil && member != nil {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
@@ -1,24 +1,36 @@
 package sphere
 
-import "github.com/gorilla/websocket"
+import "github.com/streamrail/concurrent-map"
 
 // DefaultSimpleBroker creates a new instance of SimpleBroker
 func DefaultSimpleBroker() *SimpleBroker {
 	return &SimpleBroker{
 		ExtendBroker(),
+		cmap.New(),
 	}
 }
 
 // SimpleBroker is a broker adapter built on Simple client
 type SimpleBroker struct {
 	*Broker
+	// pattern channels, matched against every published packet
+	patterns cmap.ConcurrentMap
 }
 
 type simpleBrokerPubSub struct {
+	channel *Channel
 	receive chan *Packet
 	done    chan bool
 }
 
+// send hands a packet to the subscriber, packets sent once it stopped are dropped
+func (pubsub *simpleBrokerPubSub) send(p *Packet) {
+	select {
+	case pubsub.receive <- p:
+	case <-pubsub.done:
+	}
+}
+
 // OnSubscribe when websocket subscribes to a channel
 func (broker *SimpleBroker) OnSubscribe(channel *Channel, done chan<- IError) {
 	go func() {
@@ -27,8 +39,11 @@ func (broker *SimpleBroker) OnSubscribe(channel *Channel, done chan<- IError) {
 			return
 		}
 		// creates subscribe pubsub
-		pubsub := &simpleBrokerPubSub{receive: make(chan *Packet), done: make(chan bool)}
+		pubsub := &simpleBrokerPubSub{channel: channel, receive: make(chan *Packet), done: make(chan bool)}
 		broker.store.Set(channel.Name(), pubsub)
+		if channel.IsPattern() {
+			broker.patterns.Set(channel.Name(), pubsub)
+		}
 		done <- nil
 		for {
 			select {
@@ -50,8 +65,9 @@ func (broker *SimpleBroker) OnUnsubscribe(channel *Channel, done chan<- IError)
 		}
 		if tmp, ok := broker.store.Get(channel.Name()); ok {
 			if pubsub, ok := tmp.(*simpleBrokerPubSub); ok {
+				broker.patterns.Remove(channel.Name())
 				pubsub.done <- true
-				close(pubsub.receive)
+				// receive stays open, a publisher racing with the unsubscribe sees done instead
 				close(pubsub.done)
 				broker.store.Remove(channel.Name())
 			}
@@ -67,9 +83,19 @@ func (broker *SimpleBroker) OnPublish(channel *Channel, data *Packet) error {
 		if broker.store.Has(channel.Name()) {
 			if tmp, ok := broker.store.Get(channel.Name()); ok {
 				if pubsub, ok := tmp.(*simpleBrokerPubSub); ok {
-					pubsub.receive <- data
+					pubsub.send(data)
 				}
 			}
+		} else if channel.direct() {
+			// no connection or user is listening on this channel
+			c <- ErrNotFound
+			return
+		}
+		// pattern channels get the packets of the rooms they match
+		for item := range broker.patterns.IterBuffered() {
+			if pubsub, ok := item.Val.(*simpleBrokerPubSub); ok && pubsub.channel.Match(channel.namespace, channel.room) {
+				pubsub.send(data)
+			}
 		}
 		c <- nil
 	}()
@@ -80,10 +106,7 @@ func (broker *SimpleBroker) OnPublish(channel *Channel, data *Packet) error {
 func (broker *SimpleBroker) OnMessage(channel *Channel, data *Packet) error {
 	c := make(chan error)
 	go func() {
-		if json, err := data.ToJSON(); err == nil {
-			channel.Emit(websocket.TextMessage, json, nil)
-		}
-		c <- nil
+		c <- channel.Deliver(data)
 	}()
 	return <-c
 }
@@ -1,8 +1,18 @@
 package sphere
 
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
 // NewChannel creates new Channel instance
 func NewChannel(namespace string, room string) *Channel {
-	return &Channel{namespace: namespace, room: room, state: ChannelStatePending, connections: newConnectionMap()}
+	channel := &Channel{namespace: namespace, room: room, state: ChannelStatePending, connections: newConnectionMap(), members: map[string]*Member{}}
+	if isPattern(room) {
+		channel.pattern = strings.Split(room, "/")
+	}
+	return channel
 }
 
 // Channel let you subscribe to and watch for incoming data which is published on that channel by other clients or the server
@@ -11,6 +21,19 @@ type Channel struct {
 	room        string
 	state       ChannelState
 	connections connectionmap
+	// handler receives the packets instead of the connections, it is set on internal channels and on
+	// channels whose messages are acknowledged
+	handler func(*Packet) IError
+	// stamp returns the packet with the sequence of the history of this node
+	stamp func(*Packet) *Packet
+	// guards members
+	mu sync.RWMutex
+	// presence members of the local connections
+	members map[string]*Member
+	// segments of the room when it is a pattern
+	pattern []string
+	// server-side listeners, guarded by mu
+	listeners []*listener
 }
 
 // Name returns the name of the channel
@@ -32,6 +55,44 @@ func (channel *Channel) Connections() []*Connection {
 	return conns
 }
 
+// Members returns the presence members of the local connections
+func (channel *Channel) Members() []*Member {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	members := make([]*Member, 0, len(channel.members))
+	for _, member := range channel.members {
+		members = append(members, member)
+	}
+	return members
+}
+
+// member returns the presence member of a connection
+func (channel *Channel) member(id string) (*Member, bool) {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	member, ok := channel.members[id]
+	return member, ok
+}
+
+// setMember sets the presence member of a connection, it returns false when the connection is
+// already a member
+func (channel *Channel) setMember(id string, member *Member) bool {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	if _, ok := channel.members[id]; ok {
+		return false
+	}
+	channel.members[id] = member
+	return true
+}
+
+// removeMember removes the presence member of a connection
+func (channel *Channel) removeMember(id string) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	delete(channel.members, id)
+}
+
 // subscribe this channel
 func (channel *Channel) subscribe(c *Connection) IError {
 	state := channel.isSubscribed(c)
@@ -50,27 +111,135 @@ func (channel *Channel) unsubscribe(c *Connection) IError {
 	return nil
 }
 
+// IsPattern checks if the room of the channel is a pattern matching other rooms
+func (channel *Channel) IsPattern() bool {
+	return channel.pattern != nil
+}
+
+// Match checks if a packet published to the room of the namespace is delivered to the channel
+func (channel *Channel) Match(namespace string, room string) bool {
+	if channel.namespace != namespace {
+		return false
+	}
+	if channel.pattern == nil {
+		return channel.room == room
+	}
+	return matchSegments(channel.pattern, strings.Split(room, "/"))
+}
+
+// listen adds a server-side listener
+func (channel *Channel) listen(l *listener) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	channel.listeners = append(channel.listeners, l)
+}
+
+// unlisten removes a server-side listener
+func (channel *Channel) unlisten(l *listener) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	for i, item := range channel.listeners {
+		if item == l {
+			channel.listeners = append(channel.listeners[:i:i], channel.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// listening checks if a server-side listener is listening to the channel
+func (channel *Channel) listening() bool {
+	channel.mu.RLock()
+	defer channel.mu.RUnlock()
+	return len(channel.listeners) > 0
+}
+
+// direct checks if channel is an internal channel addressing a node or a user
+func (channel *Channel) direct() bool {
+	return channel.namespace == nodeNamespace || channel.namespace == userNamespace
+}
+
 // isSubscribed checks if connection is in the connection list
 func (channel *Channel) isSubscribed(c *Connection) bool {
 	return channel.connections.Has(c.id)
 }
 
-// Emit sends message to current channel
+// Deliver sends a packet received from the broker to the channel
+func (channel *Channel) Deliver(p *Packet) IError {
+	if channel.stamp != nil {
+		p = channel.stamp(p)
+	}
+	channel.mu.RLock()
+	listeners := channel.listeners
+	channel.mu.RUnlock()
+	for _, l := range listeners {
+		c := *p
+		l.handler(&c)
+	}
+	if channel.handler != nil {
+		return channel.handler(p)
+	}
+	return channel.deliver(p, channel.skip(p))
+}
+
+// skip returns the skip function of the excluded sender and of the connections that already got the
+// packet replayed
+func (channel *Channel) skip(p *Packet) func(*Connection) bool {
+	return func(conn *Connection) bool {
+		if p.Except != "" && conn.id == p.Except {
+			return true
+		}
+		if p.Seq == 0 {
+			return false
+		}
+		tmp, ok := conn.replayed.Get(channel.Name())
+		if !ok {
+			return false
+		}
+		return tmp.(uint64) >= p.Seq
+	}
+}
+
+// Emit queues message to every connection of current channel except c. The payload is framed
+// once and the prepared message is shared by all connections, slow connections are handled by their
+// overflow policy and the broadcast never waits for longer than the send timeout in total
 func (channel *Channel) Emit(mt int, payload []byte, c *Connection) IError {
-	l := channel.connections.Count()
-	e := make(chan error, l)
-	go func() {
-		for item := range channel.connections.Iter() {
-			conn := item.Val
-			if conn != c {
-				e <- conn.emit(mt, payload)
-			} else {
-				e <- nil
-			}
+	return channel.emit(mt, payload, func(conn *Connection) bool {
+		return conn == c
+	})
+}
+
+// deliver queues the packet to every connection of current channel that is not skipped, the packet
+// is encoded once for every codec spoken by the connections
+func (channel *Channel) deliver(p *Packet, skip func(*Connection) bool) IError {
+	e := newEncodings(p)
+	var until time.Time
+	for _, conn := range channel.Connections() {
+		if skip(conn) {
+			continue
+		}
+		pm, err := e.prepare(conn)
+		if err != nil {
+			return err
+		}
+		if err := conn.enqueueUntil(conn.codec.MessageType(), pm, &until); err != nil && err != ErrSlowConsumer && err != ErrConnectionClosed {
+			LogError(err)
+		}
+	}
+	return nil
+}
+
+// emit queues message to every connection of current channel that is not skipped
+func (channel *Channel) emit(mt int, payload []byte, skip func(*Connection) bool) IError {
+	pm, err := newPrepared(mt, payload)
+	if err != nil {
+		return err
+	}
+	var until time.Time
+	for _, conn := range channel.Connections() {
+		if skip(conn) {
+			continue
 		}
-	}()
-	for i := 0; i < l; i++ {
-		if err := <-e; err != nil {
+		if err := conn.enqueueUntil(mt, pm, &until); err != nil && err != ErrSlowConsumer && err != ErrConnectionClosed {
 			LogError(err)
 		}
 	}
@@ -0,0 +1,181 @@
+package sphere
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// discardConn is a net.Conn that counts and discards everything written to it
+type discardConn struct {
+	net.Conn
+	written *int64
+	closed  chan struct{}
+}
+
+func (c *discardConn) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.written, int64(len(b)))
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *discardConn) SetDeadline(t time.Time) error      { return nil }
+func (c *discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// hijackRecorder upgrades a request onto a discardConn without a real socket
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	conn *discardConn
+}
+
+func (r *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return r.conn, bufio.NewReadWriter(bufio.NewReader(r.conn), bufio.NewWriter(r.conn)), nil
+}
+
+// createChannel returns a channel with n subscribed connections writing to nowhere
+func createChannel(b testing.TB, n int, written *int64) *Channel {
+	option := (&Option{PingPeriod: time.Hour, PongWait: 2 * time.Hour, SendQueueSize: 1024}).merge()
+	channel := NewChannel("bench", "room")
+	for i := 0; i < n; i++ {
+		r := httptest.NewRequest("GET", "/sync", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-Websocket-Version", "13")
+		r.Header.Set("Sec-Websocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		w := &hijackRecorder{httptest.NewRecorder(), &discardConn{written: written, closed: make(chan struct{})}}
+		conn, err := NewConnection(websocket.Upgrader{}, option, w, r, nil)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+		go conn.queue()
+		channel.subscribe(conn)
+	}
+	b.Cleanup(func() {
+		for _, conn := range channel.Connections() {
+			conn.close()
+		}
+	})
+	return channel
+}
+
+// wait blocks until the writers flushed the expected number of bytes, it fails after 5 seconds
+func wait(b testing.TB, written *int64, expected int64) {
+	eventually(b, fmt.Sprintf("%d written bytes", expected), func() bool {
+		return atomic.LoadInt64(written) >= expected
+	})
+}
+
+func benchmarkEmit(b *testing.B, n int, emit func(*Channel, *Packet)) {
+	var written int64
+	channel := createChannel(b, n, &written)
+	p := &Packet{Type: PacketTypeChannel, Namespace: "bench", Room: "room", Reply: true, Message: &Message{Event: "update", Data: json.RawMessage(`"payload"`)}}
+	json, err := p.ToJSON()
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	// unmasked server frame, 2 bytes header for small payloads
+	size := int64(len(json) + 2)
+	atomic.StoreInt64(&written, 0)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		emit(channel, p)
+		wait(b, &written, int64(i+1)*int64(n)*size)
+	}
+	b.ReportMetric(float64(b.N*n)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+// BenchmarkChannelEmit10k broadcasts a message framed once to 10k subscribers
+func BenchmarkChannelEmit10k(b *testing.B) {
+	benchmarkEmit(b, 10000, func(channel *Channel, p *Packet) {
+		json, _ := p.ToJSON()
+		channel.Emit(websocket.TextMessage, json, nil)
+	})
+}
+
+// BenchmarkPacketEmit10k marshals and frames the message for each of 10k subscribers
+func BenchmarkPacketEmit10k(b *testing.B) {
+	benchmarkEmit(b, 10000, func(channel *Channel, p *Packet) {
+		for _, conn := range channel.Connections() {
+			conn.enqueue(websocket.TextMessage, p)
+		}
+	})
+}
+
+func TestChannelEmitPrepared(t *testing.T) {
+	channel := NewChannel("test", "prepared")
+	option := DefaultOption()
+	for i := 0; i < 3; i++ {
+		channel.subscribe(&Connection{id: guid(), channels: newChannelMap(), send: make(chan *frame, 1), done: make(chan struct{}), option: option})
+	}
+	except := channel.Connections()[0]
+	if err := channel.Emit(websocket.TextMessage, []byte("hello"), except); err != nil {
+		t.Fatal(err.Error())
+	}
+	var shared *prepared
+	for _, conn := range channel.Connections() {
+		if conn == except {
+			if len(conn.send) != 0 {
+				t.Fatal("excluded connection should not receive the message")
+			}
+			continue
+		}
+		pm, ok := (<-conn.send).payload.(*prepared)
+		if !ok || (shared != nil && pm != shared) {
+			t.Fatal("connections should share one prepared message")
+		}
+		shared = pm
+	}
+}
+
+func TestChannelMatch(t *testing.T) {
+	tests := []struct {
+		room    string
+		pattern string
+		match   bool
+	}{
+		{"42", "*", true},
+		{"region/eu/status", "*", true},
+		{"region/eu/status", "region/+/status", true},
+		{"region/eu/paris/status", "region/+/status", false},
+		{"region/eu/paris/status", "region/*/status", true},
+		{"region/status", "region/*/status", false},
+		{"region/eu", "region/+", true},
+		{"region", "region/+", false},
+		{"region/eu/status", "region/eu/status", true},
+		{"region/eu/status", "region/us/status", false},
+	}
+	for _, test := range tests {
+		channel := NewChannel("orders", test.pattern)
+		if match := channel.Match("orders", test.room); match != test.match {
+			t.Errorf("%s matching %s should be %v", test.pattern, test.room, test.match)
+		}
+		if channel.Match("other", test.room) {
+			t.Errorf("%s should not match rooms of other namespaces", test.pattern)
+		}
+	}
+	if glob := globPattern("orders", "region/+/st*tus"); glob != `orders:region/*/st\*tus` {
+		t.Errorf("unexpected glob %s", glob)
+	}
+}
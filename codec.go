@@ -0,0 +1,70 @@
+package sphere
+
+import "github.com/gorilla/websocket"
+
+// ICodec encodes packets for the wire, a connection speaks the codec it asked for with the codec
+// query parameter or the websocket subprotocol, json otherwise
+type ICodec interface {
+	Name() string                      // => Codec name, used as query parameter and subprotocol
+	MessageType() int                  // => Websocket message type of the encoded packets
+	Marshal(*Packet) ([]byte, error)   // => Codec encodes a packet
+	Unmarshal([]byte) (*Packet, error) // => Codec decodes a packet
+}
+
+// JSONCodec encodes packets with json in text frames
+type JSONCodec struct{}
+
+// Name returns the name of the codec
+func (codec *JSONCodec) Name() string {
+	return "json"
+}
+
+// MessageType returns the websocket message type of the encoded packets
+func (codec *JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+// Marshal encodes the packet
+func (codec *JSONCodec) Marshal(p *Packet) ([]byte, error) {
+	return p.ToJSON()
+}
+
+// Unmarshal decodes a packet
+func (codec *JSONCodec) Unmarshal(data []byte) (*Packet, error) {
+	return ParsePacket(data)
+}
+
+// encodingKey identifies the encoding of a packet for a connection
+type encodingKey struct {
+	codec      string
+	stringData bool
+}
+
+// encodings encodes a packet once for every codec spoken by the connections it is sent to
+type encodings struct {
+	packet *Packet
+	frames map[encodingKey]*prepared
+}
+
+// newEncodings creates the encodings of a packet
+func newEncodings(p *Packet) *encodings {
+	return &encodings{packet: p, frames: map[encodingKey]*prepared{}}
+}
+
+// prepare returns the frame of the packet for the connection
+func (e *encodings) prepare(conn *Connection) (*prepared, error) {
+	key := encodingKey{conn.codec.Name(), conn.option.StringData}
+	if pm, ok := e.frames[key]; ok {
+		return pm, nil
+	}
+	data, err := conn.codec.Marshal(e.packet.client(key.stringData))
+	if err != nil {
+		return nil, err
+	}
+	pm, err := newPrepared(conn.codec.MessageType(), data)
+	if err != nil {
+		return nil, err
+	}
+	e.frames[key] = pm
+	return pm, nil
+}
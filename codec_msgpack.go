@@ -0,0 +1,471 @@
+package sphere
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// msgpackMaxDepth is the maximum nesting of arrays and maps accepted by the decoder
+const msgpackMaxDepth = 512
+
+var (
+	errMsgPackShort       = errors.New("msgpack: unexpected end of data")
+	errMsgPackUnsupported = errors.New("msgpack: unsupported value")
+	errMsgPackDepth       = errors.New("msgpack: maximum depth exceeded")
+)
+
+// MsgPackCodec encodes packets with MessagePack in binary frames, the packet has the same fields as
+// its json encoding and the message data is encoded as MessagePack values
+type MsgPackCodec struct{}
+
+// Name returns the name of the codec
+func (codec *MsgPackCodec) Name() string {
+	return "msgpack"
+}
+
+// MessageType returns the websocket message type of the encoded packets
+func (codec *MsgPackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal encodes the packet
+func (codec *MsgPackCodec) Marshal(p *Packet) ([]byte, error) {
+	fields := map[string]interface{}{"type": p.Type.String(), "cid": int64(p.Cid), "reply": p.Reply}
+	if p.Namespace != "" {
+		fields["namespace"] = p.Namespace
+	}
+	if p.Room != "" {
+		fields["room"] = p.Room
+	}
+	if p.Error != nil {
+		fields["error"] = p.Error.Error()
+	}
+	if p.Message != nil {
+		msg := map[string]interface{}{}
+		if p.Message.Event != "" {
+			msg["event"] = p.Message.Event
+		}
+		if len(p.Message.Data) > 0 {
+			d := json.NewDecoder(bytes.NewReader(p.Message.Data))
+			d.UseNumber()
+			var data interface{}
+			if err := d.Decode(&data); err != nil {
+				return nil, err
+			}
+			msg["data"] = data
+		}
+		fields["message"] = msg
+	}
+	if p.Seq != 0 {
+		fields["seq"] = p.Seq
+	}
+	if p.Time != 0 {
+		fields["time"] = p.Time
+	}
+	if p.ID != "" {
+		fields["id"] = p.ID
+	}
+	if p.Except != "" {
+		fields["except"] = p.Except
+	}
+	if p.Machine != "" {
+		fields["machine"] = p.Machine
+	}
+	w := &msgpackWriter{}
+	if err := w.value(fields); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// Unmarshal decodes a packet
+func (codec *MsgPackCodec) Unmarshal(data []byte) (*Packet, error) {
+	r := &msgpackReader{data: data}
+	v, err := r.value(0)
+	if err != nil || r.pos != len(data) {
+		return nil, ErrPacketBadScheme
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ErrPacketBadScheme
+	}
+	p := &Packet{}
+	ok = true
+	for key, val := range fields {
+		switch key {
+		case "type":
+			s, valid := val.(string)
+			p.Type.UnmarshalJSON([]byte(s))
+			ok = ok && valid
+		case "namespace":
+			p.Namespace, ok = msgpackString(val, ok)
+		case "room":
+			p.Room, ok = msgpackString(val, ok)
+		case "cid":
+			var cid int64
+			cid, ok = msgpackInt(val, ok)
+			p.Cid = int(cid)
+		case "error":
+			var s string
+			if s, ok = msgpackString(val, ok); s != "" {
+				p.Error = &Error{s}
+			}
+		case "reply":
+			var valid bool
+			p.Reply, valid = val.(bool)
+			ok = ok && valid
+		case "seq":
+			var seq int64
+			seq, ok = msgpackInt(val, ok)
+			p.Seq = uint64(seq)
+		case "time":
+			p.Time, ok = msgpackInt(val, ok)
+		case "id":
+			p.ID, ok = msgpackString(val, ok)
+		case "except":
+			p.Except, ok = msgpackString(val, ok)
+		case "machine":
+			p.Machine, ok = msgpackString(val, ok)
+		case "message":
+			msg, valid := val.(map[string]interface{})
+			if !valid {
+				ok = false
+				break
+			}
+			p.Message = &Message{}
+			if event, exists := msg["event"]; exists {
+				p.Message.Event, ok = msgpackString(event, ok)
+			}
+			if data, exists := msg["data"]; exists {
+				raw, err := json.Marshal(data)
+				if err != nil {
+					ok = false
+					break
+				}
+				p.Message.Data = raw
+			}
+		}
+	}
+	if !ok {
+		return nil, ErrPacketBadScheme
+	}
+	return p, nil
+}
+
+// msgpackString returns the string of a decoded value, ok turns false when it is not a string
+func msgpackString(v interface{}, ok bool) (string, bool) {
+	s, valid := v.(string)
+	return s, ok && valid
+}
+
+// msgpackInt returns the integer of a decoded value, ok turns false when it is not an integer
+func msgpackInt(v interface{}, ok bool) (int64, bool) {
+	switch i := v.(type) {
+	case int64:
+		return i, ok
+	case uint64:
+		return int64(i), ok
+	}
+	return 0, false
+}
+
+// msgpackWriter encodes values decoded from json into MessagePack
+type msgpackWriter struct {
+	bytes.Buffer
+}
+
+// value encodes a value
+func (w *msgpackWriter) value(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0xc0)
+	case bool:
+		if v {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case int64:
+		w.int(v)
+	case uint64:
+		w.uint(v)
+	case float64:
+		w.WriteByte(0xcb)
+		w.bits(math.Float64bits(v), 8)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			w.int(i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			w.uint(u)
+		} else if f, err := v.Float64(); err == nil {
+			return w.value(f)
+		} else {
+			return err
+		}
+	case string:
+		w.header(len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		w.WriteString(v)
+	case []byte:
+		w.header(len(v), 0, 0, 0xc4, 0xc5, 0xc6)
+		w.Write(v)
+	case []interface{}:
+		w.header(len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := w.value(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		w.header(len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			w.value(key)
+			if err := w.value(v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errMsgPackUnsupported
+	}
+	return nil
+}
+
+// header writes the format and the length of a string, binary, array or map, formats that do not
+// exist for a type are zero
+func (w *msgpackWriter) header(n int, fix byte, fixMax int, f8 byte, f16 byte, f32 byte) {
+	switch {
+	case n < fixMax:
+		w.WriteByte(fix | byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		w.WriteByte(f8)
+		w.bits(uint64(n), 1)
+	case n <= math.MaxUint16:
+		w.WriteByte(f16)
+		w.bits(uint64(n), 2)
+	default:
+		w.WriteByte(f32)
+		w.bits(uint64(n), 4)
+	}
+}
+
+// int writes a signed integer in its smallest format
+func (w *msgpackWriter) int(i int64) {
+	switch {
+	case i >= 0:
+		w.uint(uint64(i))
+	case i >= -32:
+		w.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		w.WriteByte(0xd0)
+		w.bits(uint64(i), 1)
+	case i >= math.MinInt16:
+		w.WriteByte(0xd1)
+		w.bits(uint64(i), 2)
+	case i >= math.MinInt32:
+		w.WriteByte(0xd2)
+		w.bits(uint64(i), 4)
+	default:
+		w.WriteByte(0xd3)
+		w.bits(uint64(i), 8)
+	}
+}
+
+// uint writes an unsigned integer in its smallest format
+func (w *msgpackWriter) uint(u uint64) {
+	switch {
+	case u <= math.MaxInt8:
+		w.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		w.WriteByte(0xcc)
+		w.bits(u, 1)
+	case u <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		w.bits(u, 2)
+	case u <= math.MaxUint32:
+		w.WriteByte(0xce)
+		w.bits(u, 4)
+	default:
+		w.WriteByte(0xcf)
+		w.bits(u, 8)
+	}
+}
+
+// bits writes the n low bytes of u in big endian order
+func (w *msgpackWriter) bits(u uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.WriteByte(byte(u >> (8 * uint(i))))
+	}
+}
+
+// msgpackReader decodes MessagePack into values that can be encoded to json, integers are int64
+// unless they only fit an uint64 and map keys must be strings
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+// next returns the next n bytes
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errMsgPackShort
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// bits reads a big endian unsigned integer of n bytes
+func (r *msgpackReader) bits(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// length reads a length of n bytes
+func (r *msgpackReader) length(n int) (int, error) {
+	u, err := r.bits(n)
+	if err != nil {
+		return 0, err
+	}
+	// every item takes at least a byte, longer lengths cannot be satisfied by the data left
+	if u > uint64(len(r.data)-r.pos) {
+		return 0, errMsgPackShort
+	}
+	return int(u), nil
+}
+
+// value decodes the next value
+func (r *msgpackReader) value(depth int) (interface{}, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgPackDepth
+	}
+	b, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return r.object(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return r.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return r.str(int(c & 0x1f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.length(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		b, _ := r.next(n)
+		return append([]byte{}, b...), nil
+	case 0xca:
+		u, err := r.bits(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := r.bits(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.bits(1 << (c - 0xcc))
+		if u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := uint(1 << (c - 0xd0))
+		u, err := r.bits(int(n))
+		// sign extend the n bytes
+		shift := 64 - 8*n
+		return int64(u<<shift) >> shift, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return r.str(n)
+	case 0xdc, 0xdd:
+		n, err := r.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return r.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := r.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return r.object(n, depth)
+	}
+	// extension types have no json equivalent
+	return nil, errMsgPackUnsupported
+}
+
+// str decodes a string of n bytes
+func (r *msgpackReader) str(n int) (interface{}, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// array decodes an array of n values
+func (r *msgpackReader) array(n int, depth int) (interface{}, error) {
+	list := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// object decodes a map of n pairs
+func (r *msgpackReader) object(n int, depth int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errMsgPackUnsupported
+		}
+		v, err := r.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
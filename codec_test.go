@@ -0,0 +1,162 @@
+package sphere
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMsgPackCodec(t *testing.T) {
+	codec := &MsgPackCodec{}
+	data := `{"big":18446744073709551615,"list":[1,-1,-200,-70000,-5000000000,300,70000,5000000000,1.5,true,null],"long":"` + strings.Repeat("x", 300) + `","nested":{"a":{"b":[]}}}`
+	p := &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "codec", Cid: 7, Error: ErrNotSupported, Message: &Message{Event: "update", Data: json.RawMessage(data)}, Reply: true, Seq: 3, Time: 1500000000000, ID: "id", Except: "except"}
+	b, err := codec.Marshal(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r, err := codec.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.Type != p.Type || r.Namespace != p.Namespace || r.Room != p.Room || r.Cid != p.Cid || r.Error == nil || r.Error.Error() != p.Error.Error() || !r.Reply || r.Seq != p.Seq || r.Time != p.Time || r.ID != p.ID || r.Except != p.Except {
+		t.Fatalf("unexpected packet %v", r)
+	}
+	if r.Message.Event != "update" || string(r.Message.Data) != data {
+		t.Fatalf("unexpected message data %s", r.Message.Data)
+	}
+	// the json and the msgpack encodings carry the same packet
+	j, _ := p.ToJSON()
+	if r, _ := (&JSONCodec{}).Unmarshal(j); r.String() != p.String() {
+		t.Fatalf("unexpected json packet %v", r)
+	}
+	for _, bad := range [][]byte{nil, {0x81}, {0x93, 0x01}, {0xc1}, {0xdd, 0xff, 0xff, 0xff, 0xff}, append(b, 0x00), []byte(`{"type":"ping"}`)} {
+		if _, err := codec.Unmarshal(bad); err != ErrPacketBadScheme {
+			t.Fatalf("expected bad scheme error for %x, got %v", bad, err)
+		}
+	}
+}
+
+func TestBrokerCodec(t *testing.T) {
+	broker := ExtendBroker()
+	if broker.Codec().Name() != "json" {
+		t.Fatal("nodes should exchange json by default")
+	}
+	p := &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "codec", Message: &Message{Event: "update", Data: json.RawMessage(`[1,2]`)}, Seq: 3, Machine: broker.ID()}
+	b, err := (&MsgPackCodec{}).Marshal(p)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// json and msgpack are understood whatever the codec of the node
+	j, _ := p.ToJSON()
+	for _, codec := range []ICodec{&JSONCodec{}, &MsgPackCodec{}} {
+		broker.SetCodec(codec)
+		for _, payload := range [][]byte{b, j} {
+			r, err := broker.decode(payload)
+			if err != nil || r.String() != p.String() || r.Machine != broker.ID() {
+				t.Fatalf("%s: unexpected packet %v, %v", codec.Name(), r, err)
+			}
+		}
+	}
+	// the origin node is never sent to the clients
+	if c := p.client(false); c.Machine != "" || strings.Contains(c.String(), broker.ID()) {
+		t.Fatalf("unexpected client packet %v", c)
+	}
+}
+
+func TestSphereCodec(t *testing.T) {
+	s := Default()
+	s.Models(&TestSphereModel{ExtendChannelModel("codec")})
+	ts, u := serve(s)
+	defer ts.Close()
+	codec := &MsgPackCodec{}
+	dial := func(url string, header http.Header) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return c
+	}
+	query := dial(u+"?codec=msgpack", nil)
+	defer query.Close()
+	subprotocol := dial(u, http.Header{"Sec-Websocket-Protocol": {"unknown, msgpack"}})
+	defer subprotocol.Close()
+	if subprotocol.Subprotocol() != "msgpack" {
+		t.Fatalf("unexpected subprotocol %q", subprotocol.Subprotocol())
+	}
+	for _, c := range []*websocket.Conn{query, subprotocol} {
+		b, _ := codec.Marshal(&Packet{Type: PacketTypeSubscribe, Namespace: "codec", Room: "room", Cid: 1})
+		if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			t.Fatal(err.Error())
+		}
+		mt, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if r, err := codec.Unmarshal(msg); mt != websocket.BinaryMessage || err != nil || r.Type != PacketTypeSubscribed || r.Cid != 1 {
+			t.Fatalf("unexpected reply %v, %v", r, err)
+		}
+	}
+	// json connections receive the same message
+	text := dial(u, nil)
+	defer text.Close()
+	send(t, text, &Packet{Type: PacketTypeSubscribe, Namespace: "codec", Room: "room", Cid: 1})
+	expect(t, text, func(p *Packet) bool { return p.Reply && p.Cid == 1 })
+	if err := s.Publish("codec", "room", "update", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, c := range []*websocket.Conn{query, subprotocol} {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if r, err := codec.Unmarshal(msg); err != nil || r.Type != PacketTypeChannel || string(r.Message.Data) != `{"a":1}` {
+			t.Fatalf("unexpected message %v, %v", r, err)
+		}
+	}
+	if r := expect(t, text, func(p *Packet) bool { return p.Type == PacketTypeChannel }); string(r.Message.Data) != `{"a":1}` {
+		t.Fatalf("unexpected message %v", r)
+	}
+	if _, res, err := websocket.DefaultDialer.Dial(u+"?codec=unknown", nil); err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown codecs should be rejected, got %v", err)
+	}
+}
+
+func TestSphereCodecSendToUser(t *testing.T) {
+	s := Default(AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	}))
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u+"?codec=msgpack&user=alice", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	eventually(t, "alice to be bound", func() bool { return s.broker.IsSubscribed(userNamespace, "alice") })
+	if err := s.SendToUser("alice", "greeting", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err.Error())
+	}
+	mt, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r, err := (&MsgPackCodec{}).Unmarshal(msg); mt != websocket.BinaryMessage || err != nil || r.Type != PacketTypeMessage || r.Message.Event != "greeting" || string(r.Message.Data) != `{"a":1}` {
+		t.Fatalf("expected a msgpack message, got %d %v, %v", mt, r, err)
+	}
+}
+
+func TestPacketTypeValues(t *testing.T) {
+	// the values of the original packet types never change
+	if PacketTypePong != 7 || PacketTypeUnknown != 8 {
+		t.Fatalf("unexpected packet type values %d, %d", PacketTypePong, PacketTypeUnknown)
+	}
+	for i, code := range PacketTypeCode {
+		var p PacketType
+		if err := json.Unmarshal([]byte(`"`+code+`"`), &p); err != nil || p != PacketType(i) {
+			t.Fatalf("expected %s to decode as %d, got %d, %v", code, i, p, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package sphere
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// CompressionStats reports the messages sent compressed to a connection
+type CompressionStats struct {
+	// Messages is the number of messages sent compressed
+	Messages uint64
+	// Bytes is the size of these messages before compression
+	Bytes uint64
+	// WireBytes is the number of bytes written to the network for these messages, frame headers
+	// included
+	WireBytes uint64
+}
+
+// Saved returns the number of bytes saved by compression, it is negative when compression made the
+// messages larger
+func (stats CompressionStats) Saved() int64 {
+	return int64(stats.Bytes) - int64(stats.WireBytes)
+}
+
+// compressionStats holds the counters of CompressionStats, they are only updated by the writer
+type compressionStats struct {
+	messages uint64
+	bytes    uint64
+	wire     uint64
+}
+
+// meteredConn counts the bytes written to the network connection
+type meteredConn struct {
+	net.Conn
+	written uint64
+}
+
+// Write writes to the network connection and counts the written bytes
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// meteredWriter hands a meteredConn to the websocket upgrader when it hijacks the connection
+type meteredWriter struct {
+	http.ResponseWriter
+	hijacker http.Hijacker
+	conn     *meteredConn
+}
+
+// Hijack takes over the network connection
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	c, rw, err := w.hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn.Conn = c
+	return w.conn, rw, nil
+}
+
+// offersCompression checks if the client offered permessage-deflate, the upgrader accepts it
+// whenever compression is enabled
+func offersCompression(r *http.Request) bool {
+	for _, value := range r.Header["Sec-Websocket-Extensions"] {
+		for _, ext := range strings.Split(value, ",") {
+			if strings.TrimSpace(strings.Split(ext, ";")[0]) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compressed writes a data message, messages of at least the compression threshold are compressed
+// when the peer negotiated compression
+func (conn *Connection) compressed(mt int, size int, write func() error) error {
+	if conn.metered == nil || (mt != websocket.TextMessage && mt != websocket.BinaryMessage) {
+		return write()
+	}
+	compress := size >= *conn.option.CompressionThreshold
+	conn.transport.(*websocketTransport).EnableWriteCompression(compress)
+	if !compress {
+		return write()
+	}
+	before := atomic.LoadUint64(&conn.metered.written)
+	err := write()
+	atomic.AddUint64(&conn.compression.messages, 1)
+	atomic.AddUint64(&conn.compression.bytes, uint64(size))
+	atomic.AddUint64(&conn.compression.wire, atomic.LoadUint64(&conn.metered.written)-before)
+	return err
+}
+
+// CompressionStats returns the statistics of the messages sent compressed to the connection
+func (conn *Connection) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Messages:  atomic.LoadUint64(&conn.compression.messages),
+		Bytes:     atomic.LoadUint64(&conn.compression.bytes),
+		WireBytes: atomic.LoadUint64(&conn.compression.wire),
+	}
+}
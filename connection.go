@@ -1,93 +1,405 @@
 package sphere
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/streamrail/concurrent-map"
 )
 
-// NewConnection returns a new ws connection instance
-func NewConnection(upgrader websocket.Upgrader, w http.ResponseWriter, r *http.Request) (*Connection, IError) {
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err == nil {
-		return &Connection{guid.String(), 0, newChannelMap(), make(chan *Packet), make(chan struct{}), r, ws}, nil
+// NewConnection returns a new ws connection instance, the read limit and deadlines of the option are applied to it
+// and the response header is sent with the upgrade response
+func NewConnection(upgrader websocket.Upgrader, option *Option, w http.ResponseWriter, r *http.Request, header http.Header) (*Connection, IError) {
+	if option == nil {
+		option = DefaultOption()
 	}
-	return nil, err
+	// the written bytes are counted to report how much compression saves
+	var metered *meteredConn
+	if upgrader.EnableCompression && option.EnableCompression && offersCompression(r) {
+		if h, ok := w.(http.Hijacker); ok {
+			metered = &meteredConn{}
+			w = &meteredWriter{w, h, metered}
+		}
+	}
+	ws, err := upgrader.Upgrade(w, r, header)
+	if err != nil {
+		return nil, err
+	}
+	if metered != nil {
+		ws.SetCompressionLevel(*option.CompressionLevel)
+	}
+	conn := newConnection(&websocketTransport{ws}, option, r)
+	conn.metered, conn.Conn = metered, ws
+	ws.SetReadLimit(option.MaxMessageSize)
+	ws.SetReadDeadline(time.Now().Add(option.PongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(option.PongWait))
+	})
+	// answer pings and close frames from the writer instead of the reading goroutine
+	ws.SetPingHandler(func(data string) error {
+		select {
+		case conn.control <- &frame{websocket.PongMessage, []byte(data)}:
+		default:
+		}
+		return nil
+	})
+	ws.SetCloseHandler(func(code int, text string) error {
+		conn.closeWith(code, "")
+		return nil
+	})
+	return conn, nil
+}
+
+// newConnection creates a connection exchanging its frames through the transport
+func newConnection(transport ITransport, option *Option, r *http.Request) *Connection {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Connection{
+		id:         guid(),
+		channels:   newChannelMap(),
+		send:       make(chan *frame, option.SendQueueSize),
+		control:    make(chan *frame, controlQueueSize),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		option:     option,
+		attributes: cmap.New(),
+		replayed:   cmap.New(),
+		calls:      cmap.New(),
+		limiters:   cmap.New(),
+		codec:      &JSONCodec{},
+		ctx:        ctx,
+		cancel:     cancel,
+		request:    r,
+		transport:  transport,
+	}
+}
+
+// controlQueueSize is the number of control frames that can wait for the writer
+const controlQueueSize = 8
+
+// IIdentity is implemented by identities that carry the id of their user
+type IIdentity interface {
+	UserID() string
+}
+
+// frame is an outbound message waiting in the connection send queue
+type frame struct {
+	mt      int
+	payload interface{}
+}
+
+// prepared is a message framed once and shared by many connections, the payload is kept for the
+// transports that do not write websocket frames
+type prepared struct {
+	*websocket.PreparedMessage
+	payload []byte
+}
+
+// newPrepared frames a message once for many connections
+func newPrepared(mt int, payload []byte) (*prepared, error) {
+	pm, err := websocket.NewPreparedMessage(mt, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &prepared{pm, payload}, nil
 }
 
 // Connection allows you to interact with backend and other client sockets in realtime
 type Connection struct {
+	// number of outbound messages dropped by the overflow policy, accessed atomically
+	dropped uint64
+	// next cid of the packets sent to the peer, accessed atomically
+	cid int64
+	// number of requests rejected by the rate limits, accessed atomically
+	rejected uint64
+	// times of the last requests rejected by the rate limits
+	rejections rejections
 	// the id of the connection
 	id string
-	// cid
-	cid int
 	// list of channels that this connection has been subscribed
 	channels channelmap
-	// buffered channel of outbound messages
-	send chan *Packet
-	// done channel
+	// bounded queue of outbound messages
+	send chan *frame
+	// control frames (pong, close), written before any queued message
+	control chan *frame
+	// done channel, closed when the connection goes away
 	done chan struct{}
+	// stopped channel, closed when the writer exits
+	stopped chan struct{}
+	// makes sure the connection is closed once
+	once sync.Once
+	// transport settings
+	option *Option
+	// guards identity and user id
+	mu sync.RWMutex
+	// identity returned by the authenticator
+	identity interface{}
+	// id of the user owning the connection
+	userID string
+	// id of the user channel the connection is bound to, guarded by the sphere
+	bound string
+	// protocol version and capabilities announced by the peer, guarded by mu
+	version      int
+	capabilities []string
+	greeted      bool
+	// attributes shared by models and hooks
+	attributes cmap.ConcurrentMap
+	// last replayed sequence per channel name
+	replayed cmap.ConcurrentMap
+	// calls waiting for the answer of the peer per cid
+	calls cmap.ConcurrentMap
+	// rate limiters of the connection, its namespaces and their events
+	limiters cmap.ConcurrentMap
+	// codec of the packets exchanged with the peer
+	codec ICodec
+	// network connection counting the written bytes, nil when compression was not negotiated
+	metered *meteredConn
+	// statistics of the messages sent compressed
+	compression compressionStats
+	// context cancelled when the connection goes away
+	ctx    context.Context
+	cancel context.CancelFunc
 	// http request
 	request *http.Request
-	// websocket connection
+	// transport carrying the frames, only the queue goroutine writes to it
+	transport ITransport
+	// websocket connection, nil when the connection is carried by a fallback transport. Messages
+	// are sent through the queue of the connection, writing to it directly races with the writer.
 	*websocket.Conn
 }
 
-// queue is the connection message queue
+// queue is the connection message queue and the only writer of the websocket connection
 func (conn *Connection) queue() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(conn.option.PingPeriod)
 	defer func() {
 		ticker.Stop()
+		close(conn.stopped)
+		conn.close()
 	}()
 	for {
+		// control frames take priority over queued messages
+		select {
+		case f := <-conn.control:
+			if !conn.write(f) {
+				return
+			}
+			continue
+		default:
+		}
 		select {
-		case packet, ok := <-conn.send:
-			if !ok {
-				conn.emit(websocket.CloseMessage, []byte{})
+		case f := <-conn.control:
+			if !conn.write(f) {
 				return
 			}
-			if err := conn.emit(websocket.TextMessage, packet); err != nil {
-				LogError(err)
+		case f := <-conn.send:
+			if !conn.write(f) {
 				return
 			}
 		case <-conn.done:
-			close(conn.done)
+			conn.flush()
 			return
 		case <-ticker.C:
-			if err := conn.emit(websocket.PingMessage, []byte{}); err != nil {
-				LogError(err)
+			if !conn.write(&frame{websocket.PingMessage, []byte{}}) {
+				return
+			}
+		}
+	}
+}
+
+// write emits a frame, it returns false when the writer has to stop
+func (conn *Connection) write(f *frame) bool {
+	if err := conn.emit(f.mt, f.payload); err != nil {
+		LogError(err)
+		return false
+	}
+	if f.mt == websocket.CloseMessage {
+		// no more frames after close, wait for the peer to finish the closing handshake
+		timer := time.NewTimer(conn.option.WriteWait)
+		defer timer.Stop()
+		select {
+		case <-conn.done:
+		case <-timer.C:
+		}
+		return false
+	}
+	return true
+}
+
+// flush writes the pending control frames before the writer exits
+func (conn *Connection) flush() {
+	for {
+		select {
+		case f := <-conn.control:
+			if err := conn.emit(f.mt, f.payload); err != nil {
 				return
 			}
+		default:
+			return
+		}
+	}
+}
+
+// enqueue puts a message into the send queue, applying the overflow policy when the queue is full
+func (conn *Connection) enqueue(mt int, payload interface{}) IError {
+	var until time.Time
+	return conn.enqueueUntil(mt, payload, &until)
+}
+
+// enqueueUntil puts a message into the send queue, OverflowPolicyBlock waits for room until the
+// deadline. A zero deadline is set to the send timeout by the first wait, so the connections of a
+// broadcast share it.
+func (conn *Connection) enqueueUntil(mt int, payload interface{}, until *time.Time) IError {
+	f := &frame{mt, payload}
+	select {
+	case <-conn.done:
+		return ErrConnectionClosed
+	case conn.send <- f:
+		return nil
+	default:
+	}
+	switch conn.option.OverflowPolicy {
+	case OverflowPolicyBlock:
+		if until.IsZero() {
+			*until = time.Now().Add(conn.option.SendTimeout)
+		}
+		timer := time.NewTimer(until.Sub(time.Now()))
+		defer timer.Stop()
+		select {
+		case conn.send <- f:
+			return nil
+		case <-conn.done:
+			return ErrConnectionClosed
+		case <-timer.C:
+		}
+	case OverflowPolicyDropOldest:
+		for {
+			select {
+			case conn.send <- f:
+				return nil
+			case <-conn.done:
+				return ErrConnectionClosed
+			default:
+			}
+			// make room by discarding the oldest message, the writer may have taken it already
+			select {
+			case <-conn.send:
+				atomic.AddUint64(&conn.dropped, 1)
+			default:
+			}
 		}
+	case OverflowPolicyDisconnect:
+		conn.closeWith(websocket.ClosePolicyViolation, ErrSlowConsumer.Error())
 	}
+	atomic.AddUint64(&conn.dropped, 1)
+	return ErrSlowConsumer
 }
 
-// write
+// closeWith asks the writer to send a close frame with the given code, the socket is released
+// once the peer answers or the write wait expires
+func (conn *Connection) closeWith(code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	select {
+	case conn.control <- &frame{websocket.CloseMessage, msg}:
+	case <-conn.done:
+	default:
+		// control queue is full, the peer is not reading at all. The socket is released in the
+		// background so that the producer never waits for the writer.
+		go conn.close()
+	}
+}
 
-// write writes a message with the given message type and payload.
+// emit writes a message with the given message type and payload, it must only be called by the writer
 func (conn *Connection) emit(mt int, payload interface{}) IError {
-	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	conn.transport.SetWriteDeadline(time.Now().Add(conn.option.WriteWait))
 	switch msg := payload.(type) {
 	case []byte:
-		return conn.WriteMessage(mt, msg)
+		return conn.compressed(mt, len(msg), func() error {
+			return conn.transport.WriteMessage(mt, msg)
+		})
+	case *prepared:
+		return conn.compressed(mt, len(msg.payload), func() error {
+			if ws, ok := conn.transport.(*websocketTransport); ok {
+				return ws.WritePreparedMessage(msg.PreparedMessage)
+			}
+			return conn.transport.WriteMessage(mt, msg.payload)
+		})
 	case *Packet:
 		if msg == nil {
 			return ErrBadScheme
 		}
 		if !msg.Reply {
-			msg.Cid = conn.cid
+			msg.Cid = conn.nextCid()
 		}
-		json, err := msg.ToJSON()
+		data, err := conn.codec.Marshal(msg.client(conn.option.StringData))
 		if err != nil {
 			return err
 		}
-		return conn.WriteMessage(websocket.TextMessage, json)
+		return conn.compressed(conn.codec.MessageType(), len(data), func() error {
+			return conn.transport.WriteMessage(conn.codec.MessageType(), data)
+		})
+	}
+	return ErrBadScheme
+}
+
+// nextCid returns the cid of the next packet sent to the peer
+func (conn *Connection) nextCid() int {
+	return int(atomic.AddInt64(&conn.cid, 1) - 1)
+}
+
+// Call sends an event to the peer and waits for its answer, the peer answers with a call packet
+// carrying the same cid. The data is encoded to json, the answer is returned as a message that can
+// be decoded. The call fails when the context is done or the connection goes away.
+func (conn *Connection) Call(ctx context.Context, event string, data interface{}) (*Message, IError) {
+	if event == "" {
+		return nil, ErrBadScheme
+	}
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return nil, err
+	}
+	p := &Packet{Type: PacketTypeCall, Cid: conn.nextCid(), Message: msg}
+	// the packet is sent as bytes so that the writer keeps its cid
+	payload, e := conn.codec.Marshal(p.client(conn.option.StringData))
+	if e != nil {
+		return nil, e
+	}
+	key := strconv.Itoa(p.Cid)
+	answer := make(chan *Packet, 1)
+	conn.calls.Set(key, answer)
+	defer conn.calls.Remove(key)
+	if err := conn.enqueue(conn.codec.MessageType(), payload); err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-answer:
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if r.Message == nil {
+			return &Message{Event: event}, nil
+		}
+		return r.Message, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-conn.done:
+		return nil, ErrConnectionClosed
+	}
+}
+
+// resolve hands an answer of the peer to the pending call with the same cid, answers arriving after
+// the call gave up are dropped
+func (conn *Connection) resolve(p *Packet) {
+	if tmp, ok := conn.calls.Get(strconv.Itoa(p.Cid)); ok {
+		select {
+		case tmp.(chan *Packet) <- p:
+		default:
+		}
 	}
-	defer func() {
-		conn.cid++
-	}()
-	return nil
 }
 
 // subscribe to channel
@@ -105,6 +417,7 @@ func (conn *Connection) subscribe(channel *Channel) IError {
 func (conn *Connection) unsubscribe(channel *Channel) IError {
 	if conn.isSubscribed(channel) {
 		conn.channels.Remove(channel.Name())
+		conn.replayed.Remove(channel.Name())
 	}
 	if channel.connections.Has(conn.id) {
 		channel.connections.Remove(conn.id)
@@ -117,9 +430,29 @@ func (conn *Connection) isSubscribed(channel *Channel) bool {
 	return conn.channels.Has(channel.Name())
 }
 
-// close connection
+// close stops the connection queue and releases the underlying socket after the writer exits
 func (conn *Connection) close() {
-	conn.done <- struct{}{}
+	conn.once.Do(func() {
+		close(conn.done)
+		if conn.cancel != nil {
+			conn.cancel()
+		}
+		timer := time.NewTimer(conn.option.WriteWait)
+		defer timer.Stop()
+		select {
+		case <-conn.stopped:
+		case <-timer.C:
+		}
+		conn.transport.Close()
+	})
+}
+
+// Context returns a context that is cancelled when the connection goes away
+func (conn *Connection) Context() context.Context {
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
 }
 
 // Cookies export connection cookies
@@ -127,6 +460,132 @@ func (conn *Connection) Cookies() []*http.Cookie {
 	return conn.request.Cookies()
 }
 
+// Dropped returns the number of outbound messages dropped because the connection could not keep up
+func (conn *Connection) Dropped() uint64 {
+	return atomic.LoadUint64(&conn.dropped)
+}
+
+// Version returns the protocol version announced by the peer, zero when the peer predates
+// versioning
+func (conn *Connection) Version() int {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.version
+}
+
+// Capabilities returns the capabilities announced by the peer in its hello packet
+func (conn *Connection) Capabilities() []string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return append([]string{}, conn.capabilities...)
+}
+
+// HasCapability checks if the peer announced the capability
+func (conn *Connection) HasCapability(name string) bool {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	for _, capability := range conn.capabilities {
+		if capability == name {
+			return true
+		}
+	}
+	return false
+}
+
+// greet records the hello of the peer, it fails when the peer already said hello or announced
+// another version with the subprotocol
+func (conn *Connection) greet(version int, capabilities []string) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.greeted || (conn.version != 0 && conn.version != version) {
+		return false
+	}
+	conn.greeted, conn.version, conn.capabilities = true, version, capabilities
+	return true
+}
+
+// Transport returns the name of the transport carrying the connection
+func (conn *Connection) Transport() string {
+	return conn.transport.Name()
+}
+
+// Codec returns the codec of the packets exchanged with the peer
+func (conn *Connection) Codec() ICodec {
+	return conn.codec
+}
+
+// Rejected returns the number of requests rejected because the connection exceeded a rate limit
+func (conn *Connection) Rejected() uint64 {
+	return atomic.LoadUint64(&conn.rejected)
+}
+
+// throttled counts a rejected request and checks if max requests were rejected within the window
+func (conn *Connection) throttled(max int, window time.Duration) bool {
+	atomic.AddUint64(&conn.rejected, 1)
+	return max > 0 && conn.rejections.add(time.Now(), max, window)
+}
+
+// ID returns the unique id of the connection
+func (conn *Connection) ID() string {
+	return conn.id
+}
+
+// RemoteAddr returns the remote network address of the connection
+func (conn *Connection) RemoteAddr() net.Addr {
+	return conn.transport.RemoteAddr()
+}
+
+// Identity returns the identity attached by the authenticator during the handshake
+func (conn *Connection) Identity() interface{} {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.identity
+}
+
+// SetIdentity attaches an identity to the connection, the user id is taken from identities that
+// are a string or implement IIdentity
+func (conn *Connection) SetIdentity(identity interface{}) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.identity = identity
+	switch id := identity.(type) {
+	case string:
+		conn.userID = id
+	case IIdentity:
+		conn.userID = id.UserID()
+	}
+}
+
+// UserID returns the id of the user owning the connection
+func (conn *Connection) UserID() string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.userID
+}
+
+// SetUserID sets the id of the user owning the connection, use Sphere.BindUser to change it once
+// the connection is established
+func (conn *Connection) SetUserID(id string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.userID = id
+}
+
+// Set stores a value on the connection under the given key
+func (conn *Connection) Set(key string, value interface{}) {
+	conn.attributes.Set(key, value)
+}
+
+// Get returns the value stored on the connection under the given key
+func (conn *Connection) Get(key string) (interface{}, bool) {
+	return conn.attributes.Get(key)
+}
+
+// Delete removes the value stored on the connection under the given key
+func (conn *Connection) Delete(key string) {
+	conn.attributes.Remove(key)
+}
+
 // Headers export connection headers
 func (conn *Connection) Headers() http.Header {
 	return conn.request.Header
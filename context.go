@@ -0,0 +1,103 @@
+package sphere
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// IContextReceiver is implemented by channel and event models that handle their messages with the
+// whole request, it takes precedence over Receive. Nothing is broadcast on behalf of the model, the
+// request is answered with an empty reply when the model neither replies nor fails.
+type IContextReceiver interface {
+	ReceiveContext(*Context) IError
+}
+
+// Context is a message received from a connection, it is cancelled when the connection goes away
+// or the request times out
+type Context struct {
+	context.Context
+	// Conn is the connection that sent the message
+	Conn *Connection
+	// Namespace is the namespace of the message
+	Namespace string
+	// Room is the room of the message, empty for event models
+	Room string
+	// Packet is the received packet
+	Packet *Packet
+	sphere *Sphere
+	req    *request
+}
+
+// newContext creates the context of a request
+func (sphere *Sphere) newContext(req *request) *Context {
+	return &Context{
+		Context:   req.ctx,
+		Conn:      req.conn,
+		Namespace: req.packet.Namespace,
+		Room:      req.packet.Room,
+		Packet:    req.packet,
+		sphere:    sphere,
+		req:       req,
+	}
+}
+
+// Event returns the event of the message
+func (ctx *Context) Event() string {
+	if ctx.Packet.Message == nil {
+		return ""
+	}
+	return ctx.Packet.Message.Event
+}
+
+// Data returns the raw json data of the message
+func (ctx *Context) Data() json.RawMessage {
+	if ctx.Packet.Message == nil {
+		return nil
+	}
+	return ctx.Packet.Message.Data
+}
+
+// Text returns the data of the message as text, see Message.Text
+func (ctx *Context) Text() string {
+	if ctx.Packet.Message == nil {
+		return ""
+	}
+	return ctx.Packet.Message.Text()
+}
+
+// Decode decodes the data of the message into v, see Message.Decode
+func (ctx *Context) Decode(v interface{}) error {
+	if ctx.Packet.Message == nil {
+		return nil
+	}
+	return ctx.Packet.Message.Decode(v)
+}
+
+// Reply answers the sender of the message with data encoded to json, only the first answer is sent
+func (ctx *Context) Reply(data interface{}) IError {
+	msg, err := NewMessage(ctx.Event(), data)
+	if err != nil {
+		return err
+	}
+	r := ctx.Packet.Response()
+	r.Message = msg
+	return ctx.req.reply(r)
+}
+
+// Broadcast sends an event to every subscriber of the room, the sender included
+func (ctx *Context) Broadcast(event string, data interface{}) IError {
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return err
+	}
+	return ctx.sphere.broadcast(ctx.Namespace, ctx.Room, "", msg)
+}
+
+// BroadcastExcept sends an event to every subscriber of the room but the sender
+func (ctx *Context) BroadcastExcept(event string, data interface{}) IError {
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return err
+	}
+	return ctx.sphere.broadcast(ctx.Namespace, ctx.Room, ctx.Conn.id, msg)
+}
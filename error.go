@@ -17,9 +17,15 @@ var (
 	ErrUnauthorized     = &ProtocolError{"unauthorized"}
 	ErrServerErrors     = &ProtocolError{"server errors"}
 	ErrRequestFailed    = &ProtocolError{"request failed"}
+	ErrServerClosed     = &ProtocolError{"server closed"}
+	ErrRequestTimeout   = &ProtocolError{"request timeout"}
+	ErrBadVersion       = &ProtocolError{"unsupported protocol version"}
+	ErrMessageTooLarge  = &ProtocolError{"message too large"}
 
 	ErrAlreadySubscribed = &ClientError{"already subscribed"}
 	ErrNotSubscribed     = &ClientError{"not subscribed"}
+	ErrSlowConsumer      = &ClientError{"slow consumer"}
+	ErrConnectionClosed  = &ClientError{"connection closed"}
 
 	ErrPacketBadScheme = &PacketError{"packet bad scheme"}
 	ErrPacketBadType   = &PacketError{"packet bad type"}
@@ -64,6 +70,30 @@ func (e *PacketError) Error() string {
 	return e.s
 }
 
+// HandshakeError represents a rejected websocket handshake with the http status sent to the client.
+type HandshakeError struct {
+	Status int
+	s      string
+}
+
+// NewHandshakeError creates a HandshakeError with the given http status
+func NewHandshakeError(status int, message string) *HandshakeError {
+	return &HandshakeError{status, message}
+}
+
+// Error returns error string of HandshakeError
+func (e *HandshakeError) Error() string {
+	return e.s
+}
+
+// OptionError represents invalid settings.
+type OptionError Error
+
+// Error returns error string of OptionError
+func (e *OptionError) Error() string {
+	return e.s
+}
+
 // LogError logs the function name, line and error message
 func LogError(err IError) {
 	if err != nil {
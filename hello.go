@@ -0,0 +1,188 @@
+package sphere
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ProtocolVersion is the version of the packet protocol spoken by the server
+	ProtocolVersion = 1
+	// MinProtocolVersion is the oldest version of the packet protocol still supported
+	MinProtocolVersion = 1
+	// protocolPrefix is the prefix of the subprotocols announcing a protocol version
+	protocolPrefix = "sphere.v"
+)
+
+// List of features announced to the clients
+const (
+	FeatureAcknowledgement = "ack"
+	FeatureCall            = "call"
+	FeatureHistory         = "history"
+	FeaturePatterns        = "patterns"
+	FeaturePresence        = "presence"
+	FeatureCompression     = "compression"
+	FeatureRateLimit       = "ratelimit"
+	FeatureStringData      = "stringdata"
+)
+
+// Hello is the data of the hello packet a client sends to announce its protocol version and its
+// capabilities. Clients that never say hello speak the protocol that predates versioning.
+type Hello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Welcome is the data of the reply to a hello packet, an unsupported version is answered with the
+// supported versions only
+type Welcome struct {
+	Version    int    `json:"version"`
+	MinVersion int    `json:"minVersion"`
+	ID         string `json:"id,omitempty"`
+	// Heartbeat is the ping period of the server in milliseconds
+	Heartbeat int64    `json:"heartbeat,omitempty"`
+	Codec     string   `json:"codec,omitempty"`
+	Features  []string `json:"features,omitempty"`
+}
+
+// handshake is the result of the negotiation of a websocket upgrade
+type handshake struct {
+	codec   ICodec
+	version int
+	// subprotocol answered to the client, empty when none was accepted
+	subprotocol string
+}
+
+// protocolVersion parses a subprotocol announcing a protocol version
+func protocolVersion(subprotocol string) (int, bool) {
+	if !strings.HasPrefix(subprotocol, protocolPrefix) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(subprotocol, protocolPrefix))
+	return version, err == nil
+}
+
+// supported checks if the protocol version is spoken by the server
+func supported(version int) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// negotiate returns the codec and the protocol version asked for by the request. The codec query
+// parameter takes precedence over the subprotocols, the first subprotocol naming a supported
+// version or a codec is accepted. Requests only offering unsupported versions are rejected. A
+// subprotocol already chosen by the authenticator is the only one considered.
+func (sphere *Sphere) negotiate(r *http.Request, chosen string) (*handshake, IError) {
+	hs := &handshake{codec: sphere.codecs["json"]}
+	query := r.URL.Query().Get("codec")
+	if query != "" {
+		codec, ok := sphere.codecs[query]
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		hs.codec = codec
+	}
+	names := websocket.Subprotocols(r)
+	if chosen != "" {
+		names = []string{chosen}
+	}
+	versioned := false
+	for _, name := range names {
+		if version, ok := protocolVersion(name); ok {
+			versioned = true
+			if supported(version) {
+				hs.version, hs.subprotocol = version, name
+				return hs, nil
+			}
+			continue
+		}
+		if codec, ok := sphere.codecs[name]; ok && query == "" {
+			hs.codec, hs.subprotocol = codec, name
+			return hs, nil
+		}
+	}
+	if versioned {
+		return nil, ErrBadVersion
+	}
+	return hs, nil
+}
+
+// features returns the features enabled for the connection, the channel features are announced
+// when at least one registered channel model enables them
+func (sphere *Sphere) features(conn *Connection) []string {
+	features := []string{FeatureCall}
+	acked, kept, present, models := false, false, false, false
+	for item := range sphere.models.IterBuffered() {
+		models = true
+		if m, ok := item.Val.(IAcknowledgement); ok {
+			if attempts, _ := m.Acknowledgement(); attempts > 0 {
+				acked = true
+			}
+		}
+		if m, ok := item.Val.(IHistory); ok {
+			if size, _ := m.History(); size > 0 {
+				kept = true
+			}
+		}
+		if _, ok := item.Val.(IPresence); ok {
+			present = true
+		}
+	}
+	if acked {
+		features = append(features, FeatureAcknowledgement)
+	}
+	if kept {
+		features = append(features, FeatureHistory)
+	}
+	if models {
+		features = append(features, FeaturePatterns)
+	}
+	if present {
+		features = append(features, FeaturePresence)
+	}
+	if conn.metered != nil {
+		features = append(features, FeatureCompression)
+	}
+	if sphere.option.RateLimit.enabled() {
+		features = append(features, FeatureRateLimit)
+	}
+	if sphere.option.StringData {
+		features = append(features, FeatureStringData)
+	}
+	return features
+}
+
+// hello answers the hello packet of a client with the settings of the connection, clients asking
+// for an unsupported version are answered with the supported versions and disconnected
+func (sphere *Sphere) hello(req *request) IError {
+	p, conn := req.packet, req.conn
+	var h Hello
+	if p.Message == nil || p.Message.Decode(&h) != nil {
+		return ErrBadScheme
+	}
+	if !supported(h.Version) {
+		r := p.Response().SetError(ErrBadVersion)
+		r.Message, _ = NewMessage(PacketTypeHello.String(), &Welcome{Version: ProtocolVersion, MinVersion: MinProtocolVersion})
+		req.reply(r)
+		// the close frame is queued after the reply so that the client gets both
+		conn.enqueue(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, ErrBadVersion.Error()))
+		return nil
+	}
+	if !conn.greet(h.Version, h.Capabilities) {
+		return ErrBadStatus
+	}
+	welcome := &Welcome{
+		Version:    h.Version,
+		MinVersion: MinProtocolVersion,
+		ID:         conn.id,
+		Heartbeat:  int64(sphere.option.PingPeriod / time.Millisecond),
+		Codec:      conn.codec.Name(),
+		Features:   sphere.features(conn),
+	}
+	r := p.Response()
+	r.Message, _ = NewMessage(PacketTypeHello.String(), welcome)
+	return req.reply(r)
+}
@@ -0,0 +1,151 @@
+package sphere
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// IHistory is implemented by channel models that keep the recent messages of their rooms, so that
+// subscribers coming back after a disconnect can ask for the messages they missed. It returns the
+// maximum number and the maximum age of the kept messages, a zero size disables the history.
+type IHistory interface {
+	History() (int, time.Duration)
+}
+
+// historyLocks is the number of locks serializing the writes to the message store, channels share
+// them so that no state is kept per channel
+const historyLocks = 64
+
+// history holds the retention of a channel and the lock serializing its writes to the message store
+type history struct {
+	*sync.Mutex
+	size int
+	age  time.Duration
+}
+
+// history returns the history of the channel, nil when the model does not keep one
+func (sphere *Sphere) history(namespace string, room string) *history {
+	model, ok := sphere.models.Get(namespace)
+	if !ok {
+		return nil
+	}
+	keeper, ok := model.(IHistory)
+	if !ok {
+		return nil
+	}
+	size, age := keeper.History()
+	if size <= 0 {
+		return nil
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(sphere.broker.ChannelName(namespace, room)))
+	return &history{Mutex: &sphere.histories[hash.Sum32()%historyLocks], size: size, age: age}
+}
+
+// DeleteHistory deletes the messages kept for the room, the history of a room that is not kept
+// by its model is left untouched
+func (sphere *Sphere) DeleteHistory(namespace string, room string) IError {
+	h := sphere.history(namespace, room)
+	if h == nil {
+		return ErrNotSupported
+	}
+	h.Lock()
+	defer h.Unlock()
+	return sphere.store.Delete(sphere.broker.ChannelName(namespace, room))
+}
+
+// record stamps the packet with the current time and keeps it in the message store, which assigns
+// its sequence. Packets of other nodes keep the time they were published at.
+func (sphere *Sphere) record(p *Packet) {
+	h := sphere.history(p.Namespace, p.Room)
+	if h == nil {
+		return
+	}
+	name := sphere.broker.ChannelName(p.Namespace, p.Room)
+	h.Lock()
+	defer h.Unlock()
+	if p.Time == 0 {
+		p.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	if _, err := sphere.store.Append(name, p); err != nil {
+		LogError(err)
+		return
+	}
+	if err := sphere.store.Trim(name, h.size, h.age); err != nil {
+		LogError(err)
+	}
+}
+
+// stamp returns the stamp function of a channel. Packets published on this node are recorded
+// before they are sent to the broker, the packets of other nodes are recorded again when they are
+// delivered so that the connections of a node only get the sequences of its store. Patterns have no
+// history, they get the packets of other nodes without sequence.
+func (sphere *Sphere) stamp(channel *Channel) func(*Packet) *Packet {
+	return func(p *Packet) *Packet {
+		if p.Machine == sphere.broker.ID() {
+			return p
+		}
+		c := *p
+		c.Seq, c.Machine = 0, sphere.broker.ID()
+		if !channel.IsPattern() {
+			sphere.record(&c)
+		}
+		return &c
+	}
+}
+
+// replay subscribes the connection, replies to the subscribe request and sends the messages the
+// connection missed. The connection is subscribed under the history lock so that no message is
+// recorded in between, live messages that were recorded before are skipped by the connection. The
+// missed messages are sent once the lock is released, so they may come after newer live messages.
+func (sphere *Sphere) replay(req *request, channel *Channel) IError {
+	p, conn := req.packet, req.conn
+	// the history is kept per room, patterns only get live messages
+	var h *history
+	if !channel.IsPattern() {
+		h = sphere.history(p.Namespace, p.Room)
+	}
+	if h == nil || (p.Seq == 0 && p.Time == 0) {
+		if err := channel.subscribe(conn); err != nil {
+			return err
+		}
+		return req.reply(p.Response())
+	}
+	h.Lock()
+	if err := sphere.store.Trim(channel.Name(), h.size, h.age); err != nil {
+		h.Unlock()
+		return err
+	}
+	items, err := sphere.store.Range(channel.Name(), 0, 0)
+	if err != nil {
+		h.Unlock()
+		return err
+	}
+	if err := channel.subscribe(conn); err != nil {
+		h.Unlock()
+		return err
+	}
+	seq := p.Seq
+	if len(items) > 0 {
+		seq = items[len(items)-1].Seq
+	}
+	conn.replayed.Set(channel.Name(), seq)
+	// a slow connection must not hold the lock shared with other channels
+	h.Unlock()
+	if err := req.reply(p.Response()); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if (p.Seq > 0 && item.Seq > p.Seq) || (p.Seq == 0 && item.Time > p.Time) {
+			r := *item
+			r.Except = ""
+			if err := conn.enqueue(websocket.TextMessage, &r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
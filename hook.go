@@ -0,0 +1,78 @@
+package sphere
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// ConnectHandler is called when a websocket connection has been accepted
+type ConnectHandler func(*Connection)
+
+// DisconnectHandler is called when a websocket connection went away, with the close code and reason
+type DisconnectHandler func(*Connection, int, string)
+
+// ErrorHandler is called when a websocket connection violates the protocol
+type ErrorHandler func(*Connection, IError)
+
+// hooks is the list of registered lifecycle callbacks
+type hooks struct {
+	sync.RWMutex
+	connect    []ConnectHandler
+	disconnect []DisconnectHandler
+	errors     []ErrorHandler
+}
+
+// OnConnect registers a callback that runs after a connection is accepted and before any message is read
+func (sphere *Sphere) OnConnect(fn ConnectHandler) {
+	sphere.hooks.Lock()
+	defer sphere.hooks.Unlock()
+	sphere.hooks.connect = append(sphere.hooks.connect, fn)
+}
+
+// OnDisconnect registers a callback that runs after a connection left all of its channels
+func (sphere *Sphere) OnDisconnect(fn DisconnectHandler) {
+	sphere.hooks.Lock()
+	defer sphere.hooks.Unlock()
+	sphere.hooks.disconnect = append(sphere.hooks.disconnect, fn)
+}
+
+// OnError registers a callback that runs when a connection sends malformed data or breaks the protocol
+func (sphere *Sphere) OnError(fn ErrorHandler) {
+	sphere.hooks.Lock()
+	defer sphere.hooks.Unlock()
+	sphere.hooks.errors = append(sphere.hooks.errors, fn)
+}
+
+// connected triggers the connect callbacks
+func (sphere *Sphere) connected(conn *Connection) {
+	sphere.hooks.RLock()
+	defer sphere.hooks.RUnlock()
+	for _, fn := range sphere.hooks.connect {
+		fn(conn)
+	}
+}
+
+// disconnected triggers the disconnect callbacks with the close status found in the read error
+func (sphere *Sphere) disconnected(conn *Connection, err error) {
+	code, reason := websocket.CloseAbnormalClosure, ""
+	if e, ok := err.(*websocket.CloseError); ok {
+		code, reason = e.Code, e.Text
+	} else if err != nil {
+		reason = err.Error()
+	}
+	sphere.hooks.RLock()
+	defer sphere.hooks.RUnlock()
+	for _, fn := range sphere.hooks.disconnect {
+		fn(conn, code, reason)
+	}
+}
+
+// failed triggers the error callbacks
+func (sphere *Sphere) failed(conn *Connection, err IError) {
+	sphere.hooks.RLock()
+	defer sphere.hooks.RUnlock()
+	for _, fn := range sphere.hooks.errors {
+		fn(conn, err)
+	}
+}
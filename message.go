@@ -1,7 +1,77 @@
 package sphere
 
-// Message indicates the data of the message
+import "encoding/json"
+
+// Message indicates the data of the message, the data is any json value
 type Message struct {
-	Event string `json:"event,omitempty"`
-	Data  string `json:"data,omitempty"`
+	Event string          `json:"event,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+// NewMessage creates a message whose data is the json encoding of v, strings are sent as json
+// strings and json.RawMessage is sent as it is
+func NewMessage(event string, v interface{}) (*Message, IError) {
+	data, err := encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Event: event, Data: data}, nil
+}
+
+// encode returns the json encoding of the data of a message, nil is encoded as no data
+func encode(v interface{}) (json.RawMessage, IError) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, ErrBadScheme
+	}
+	return data, nil
+}
+
+// isString checks if the data is a json string
+func isString(data json.RawMessage) bool {
+	return len(data) > 0 && data[0] == '"'
+}
+
+// Text returns the value of the data when it is a json string and the json text of the data
+// otherwise
+func (msg *Message) Text() string {
+	if isString(msg.Data) {
+		var s string
+		if err := json.Unmarshal(msg.Data, &s); err == nil {
+			return s
+		}
+	}
+	return string(msg.Data)
+}
+
+// Decode decodes the data into v. Clients that still encode their payload into a json string are
+// supported, the string is decoded when the data does not fit v as it is.
+func (msg *Message) Decode(v interface{}) error {
+	if len(msg.Data) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(msg.Data, v)
+	if err != nil && isString(msg.Data) {
+		var s string
+		if json.Unmarshal(msg.Data, &s) == nil {
+			return json.Unmarshal([]byte(s), v)
+		}
+	}
+	return err
+}
+
+// stringify returns the message with its data encoded into a json string, for the clients that
+// only understand string data
+func (msg *Message) stringify() *Message {
+	if len(msg.Data) == 0 || isString(msg.Data) {
+		return msg
+	}
+	data, err := json.Marshal(string(msg.Data))
+	if err != nil {
+		return msg
+	}
+	return &Message{Event: msg.Event, Data: data}
 }
@@ -1,5 +1,7 @@
 package sphere
 
+import "time"
+
 // IChannels is the interface for ChannelModel
 type IChannels interface {
 	Namespace() string
@@ -10,12 +12,26 @@ type IChannels interface {
 
 // ExtendChannelModel lets developer create a IChannals compatible struct
 func ExtendChannelModel(namespace string) *ChannelModel {
-	return &ChannelModel{namespace}
+	return &ChannelModel{namespace: namespace}
 }
 
 // ChannelModel is for user to define channel events and actions
 type ChannelModel struct {
 	namespace string
+	// number of messages kept per room
+	historySize int
+	// maximum age of messages kept per room
+	historyAge time.Duration
+	// number of delivery attempts of unacknowledged messages
+	ackAttempts int
+	// delay before the first redelivery
+	ackBackoff time.Duration
+	// request limit of the namespace
+	rateLimit RateLimit
+	// request limits per event
+	eventRateLimits map[string]RateLimit
+	// event handlers registered with On
+	router *router
 }
 
 // Namespace to return name of the channel
@@ -37,3 +53,78 @@ func (m *ChannelModel) Disconnect(room string, connection *Connection) IError {
 func (m *ChannelModel) Receive(event string, message string) (string, IError) {
 	return "", nil
 }
+
+// SetHistory keeps up to size messages per room for at most age (zero keeps them until they are
+// pushed out), subscribers can ask for the messages published after a sequence or a time
+func (m *ChannelModel) SetHistory(size int, age time.Duration) {
+	m.historySize, m.historyAge = size, age
+}
+
+// History returns the number and the maximum age of the messages kept per room
+func (m *ChannelModel) History() (int, time.Duration) {
+	return m.historySize, m.historyAge
+}
+
+// SetAcknowledgement makes the clients acknowledge the messages of the rooms, a message is sent up
+// to attempts times, waiting backoff before the first retry and twice as long before each next one
+func (m *ChannelModel) SetAcknowledgement(attempts int, backoff time.Duration) {
+	m.ackAttempts, m.ackBackoff = attempts, backoff
+}
+
+// Acknowledgement returns the number of delivery attempts and the delay before the first retry
+func (m *ChannelModel) Acknowledgement() (int, time.Duration) {
+	return m.ackAttempts, m.ackBackoff
+}
+
+// SetRateLimit limits the requests of each connection to the namespace
+func (m *ChannelModel) SetRateLimit(limit RateLimit) {
+	m.rateLimit = limit
+}
+
+// SetEventRateLimit limits the requests of each connection for an event of the namespace
+func (m *ChannelModel) SetEventRateLimit(event string, limit RateLimit) {
+	if m.eventRateLimits == nil {
+		m.eventRateLimits = map[string]RateLimit{}
+	}
+	m.eventRateLimits[event] = limit
+}
+
+// RateLimit returns the request limit of the namespace and the request limit of the event
+func (m *ChannelModel) RateLimit(event string) (RateLimit, RateLimit) {
+	return m.rateLimit, m.eventRateLimits[event]
+}
+
+// On registers the handler of an event, a handler is a func(*Context) IError or a
+// func(*Context, T) IError receiving the message data decoded into T, other signatures are
+// rejected with an error. Once a handler is registered the events are no longer given to Receive,
+// unknown events are not supported and channel messages are no longer broadcast automatically,
+// handlers broadcast them with Context.Broadcast.
+func (m *ChannelModel) On(event string, handler interface{}) error {
+	r := m.router
+	if r == nil {
+		r = &router{}
+	}
+	if err := r.on(event, handler); err != nil {
+		return err
+	}
+	m.router = r
+	return nil
+}
+
+// Fallback registers the handler of the events that have no handler, it fails like On
+func (m *ChannelModel) Fallback(handler interface{}) error {
+	r := m.router
+	if r == nil {
+		r = &router{}
+	}
+	if err := r.otherwise(handler); err != nil {
+		return err
+	}
+	m.router = r
+	return nil
+}
+
+// routes returns the event handlers, nil when none has been registered
+func (m *ChannelModel) routes() *router {
+	return m.router
+}
@@ -8,12 +8,18 @@ type IEvents interface {
 
 // ExtendEventModel lets developer create a IEvents compatible struct
 func ExtendEventModel(namespace string) *EventModel {
-	return &EventModel{namespace}
+	return &EventModel{namespace: namespace}
 }
 
 // EventModel is for user to define channel events and actions
 type EventModel struct {
 	namespace string
+	// request limit of the namespace
+	rateLimit RateLimit
+	// request limits per event
+	eventRateLimits map[string]RateLimit
+	// event handlers registered with On
+	router *router
 }
 
 // Namespace to return name of the channel
@@ -25,3 +31,54 @@ func (m *EventModel) Namespace() string {
 func (m *EventModel) Receive(event string, message string) (string, IError) {
 	return "", nil
 }
+
+// SetRateLimit limits the requests of each connection to the namespace
+func (m *EventModel) SetRateLimit(limit RateLimit) {
+	m.rateLimit = limit
+}
+
+// SetEventRateLimit limits the requests of each connection for an event of the namespace
+func (m *EventModel) SetEventRateLimit(event string, limit RateLimit) {
+	if m.eventRateLimits == nil {
+		m.eventRateLimits = map[string]RateLimit{}
+	}
+	m.eventRateLimits[event] = limit
+}
+
+// RateLimit returns the request limit of the namespace and the request limit of the event
+func (m *EventModel) RateLimit(event string) (RateLimit, RateLimit) {
+	return m.rateLimit, m.eventRateLimits[event]
+}
+
+// On registers the handler of an event, a handler is a func(*Context) IError or a
+// func(*Context, T) IError receiving the message data decoded into T, other signatures are
+// rejected with an error. Once a handler is registered the events are no longer given to Receive and unknown events are not supported.
+func (m *EventModel) On(event string, handler interface{}) error {
+	r := m.router
+	if r == nil {
+		r = &router{}
+	}
+	if err := r.on(event, handler); err != nil {
+		return err
+	}
+	m.router = r
+	return nil
+}
+
+// Fallback registers the handler of the events that have no handler, it fails like On
+func (m *EventModel) Fallback(handler interface{}) error {
+	r := m.router
+	if r == nil {
+		r = &router{}
+	}
+	if err := r.otherwise(handler); err != nil {
+		return err
+	}
+	m.router = r
+	return nil
+}
+
+// routes returns the event handlers, nil when none has been registered
+func (m *EventModel) routes() *router {
+	return m.router
+}
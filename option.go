@@ -0,0 +1,192 @@
+package sphere
+
+import (
+	"compress/flate"
+	"time"
+)
+
+const (
+	// Read buffer size for websocket upgrader
+	defaultReadBufferSize = 1024
+	// Write buffer size for websocker upgrader
+	defaultWriteBufferSize = 1024
+	// Time allowed to write a message to the peer.
+	defaultWriteWait = 10 * time.Second
+	// Time allowed to read the next pong message from the peer.
+	defaultPongWait = 60 * time.Second
+	// Send pings to peer with this period. Must be less than pongWait.
+	defaultPingPeriod = (defaultPongWait * 9) / 10
+	// Maximum message size allowed from peer.
+	defaultMaxMessageSize = 64 * 1024
+	// Time allowed to complete the websocket handshake.
+	defaultHandshakeTimeout = 10 * time.Second
+	// Maximum number of outbound messages queued per connection.
+	defaultSendQueueSize = 256
+	// Time allowed to wait for room in a full send queue.
+	defaultSendTimeout = time.Second
+	// Time allowed to a model to handle a client request.
+	defaultRequestTimeout = 30 * time.Second
+	// Compression level of permessage-deflate.
+	defaultCompressionLevel = flate.BestSpeed
+	// Window within which RateLimitDisconnect rejected requests close the connection.
+	defaultRateLimitWindow = time.Minute
+	// Minimum size in bytes of the messages sent compressed.
+	defaultCompressionThreshold = 512
+)
+
+// DefaultOption returns an Option filled with the default settings
+func DefaultOption() *Option {
+	return &Option{
+		ReadBufferSize:       defaultReadBufferSize,
+		WriteBufferSize:      defaultWriteBufferSize,
+		MaxMessageSize:       defaultMaxMessageSize,
+		WriteWait:            defaultWriteWait,
+		PongWait:             defaultPongWait,
+		PingPeriod:           defaultPingPeriod,
+		HandshakeTimeout:     defaultHandshakeTimeout,
+		SendQueueSize:        defaultSendQueueSize,
+		SendTimeout:          defaultSendTimeout,
+		RequestTimeout:       defaultRequestTimeout,
+		RateLimitWindow:      defaultRateLimitWindow,
+		CompressionLevel:     Int(defaultCompressionLevel),
+		CompressionThreshold: Int(defaultCompressionThreshold),
+	}
+}
+
+// Int returns a pointer to the value, for the options whose zero value is a valid setting
+func Int(v int) *int {
+	return &v
+}
+
+// Option for Sphere, zero values are replaced with the default settings
+type Option struct {
+	// CheckOrigin rejects the cross origin requests when true, every origin is accepted when false.
+	// Cross origin requests are rejected when no Option is given.
+	CheckOrigin bool
+	// ReadBufferSize is the websocket read buffer size in bytes
+	ReadBufferSize int
+	// WriteBufferSize is the websocket write buffer size in bytes
+	WriteBufferSize int
+	// MaxMessageSize is the maximum message size in bytes allowed from peer
+	MaxMessageSize int64
+	// WriteWait is the time allowed to write a message to the peer
+	WriteWait time.Duration
+	// PongWait is the time allowed to read the next pong message from the peer
+	PongWait time.Duration
+	// PingPeriod is the period to send pings to peer, must be less than PongWait
+	PingPeriod time.Duration
+	// HandshakeTimeout is the time allowed to complete the websocket handshake
+	HandshakeTimeout time.Duration
+	// SendQueueSize is the maximum number of outbound messages queued per connection
+	SendQueueSize int
+	// OverflowPolicy decides what happens to outbound messages when the send queue is full, the
+	// oldest queued message is dropped by default
+	OverflowPolicy OverflowPolicy
+	// SendTimeout is the time a message or a broadcast is allowed to wait for room in the send queues
+	// with OverflowPolicyBlock
+	SendTimeout time.Duration
+	// RequestTimeout is the time allowed to handle a client request before it is answered with
+	// ErrRequestTimeout
+	RequestTimeout time.Duration
+	// RateLimit limits the messages and the bytes received from each connection
+	RateLimit RateLimit
+	// RateLimitDisconnect is the number of rate limited requests within RateLimitWindow after which
+	// the connection is closed, zero keeps the connection open
+	RateLimitDisconnect int
+	// RateLimitWindow is the sliding window over which the rate limited requests are counted
+	RateLimitWindow time.Duration
+	// StringData sends the data of every message to the clients as a json string, for clients that
+	// predate structured data and expect the data to be a string
+	StringData bool
+	// EnableCompression negotiates permessage-deflate with the clients that offer it
+	EnableCompression bool
+	// CompressionLevel is the flate compression level of the messages, from -2 to 9, nil keeps
+	// flate.BestSpeed
+	CompressionLevel *int
+	// CompressionThreshold is the minimum size in bytes of the messages sent compressed, smaller
+	// messages are sent uncompressed. Nil keeps 512 bytes, zero compresses every message.
+	CompressionThreshold *int
+}
+
+// Validate checks the option for invalid or inconsistent settings
+func (option *Option) Validate() IError {
+	switch {
+	case option.ReadBufferSize < 0 || option.WriteBufferSize < 0:
+		return &OptionError{"buffer size must not be negative"}
+	case option.MaxMessageSize < 0:
+		return &OptionError{"max message size must not be negative"}
+	case option.WriteWait < 0 || option.PongWait < 0 || option.PingPeriod < 0 || option.HandshakeTimeout < 0 || option.SendTimeout < 0 || option.RequestTimeout < 0 || option.RateLimitWindow < 0:
+		return &OptionError{"timeouts must not be negative"}
+	case option.SendQueueSize < 0:
+		return &OptionError{"send queue size must not be negative"}
+	case !option.RateLimit.valid() || option.RateLimitDisconnect < 0:
+		return &OptionError{"rate limits must not be negative"}
+	case option.CompressionLevel != nil && (*option.CompressionLevel < flate.HuffmanOnly || *option.CompressionLevel > flate.BestCompression):
+		return &OptionError{"compression level must be between -2 and 9"}
+	case option.CompressionThreshold != nil && *option.CompressionThreshold < 0:
+		return &OptionError{"compression threshold must not be negative"}
+	case option.OverflowPolicy < OverflowPolicyDropOldest || option.OverflowPolicy > OverflowPolicyDisconnect:
+		return &OptionError{"unknown overflow policy"}
+	case option.PingPeriod >= option.PongWait:
+		return &OptionError{"ping period must be less than pong wait"}
+	}
+	return nil
+}
+
+// merge returns a copy of the option with zero values replaced by the defaults
+func (option *Option) merge() *Option {
+	o := DefaultOption()
+	if option == nil {
+		return o
+	}
+	o.CheckOrigin = option.CheckOrigin
+	if option.ReadBufferSize != 0 {
+		o.ReadBufferSize = option.ReadBufferSize
+	}
+	if option.WriteBufferSize != 0 {
+		o.WriteBufferSize = option.WriteBufferSize
+	}
+	if option.MaxMessageSize != 0 {
+		o.MaxMessageSize = option.MaxMessageSize
+	}
+	if option.WriteWait != 0 {
+		o.WriteWait = option.WriteWait
+	}
+	if option.PongWait != 0 {
+		o.PongWait = option.PongWait
+		// keep the default ratio when only the pong wait is changed
+		if option.PingPeriod == 0 {
+			o.PingPeriod = (option.PongWait * 9) / 10
+		}
+	}
+	if option.PingPeriod != 0 {
+		o.PingPeriod = option.PingPeriod
+	}
+	if option.HandshakeTimeout != 0 {
+		o.HandshakeTimeout = option.HandshakeTimeout
+	}
+	if option.SendQueueSize != 0 {
+		o.SendQueueSize = option.SendQueueSize
+	}
+	o.OverflowPolicy = option.OverflowPolicy
+	if option.SendTimeout != 0 {
+		o.SendTimeout = option.SendTimeout
+	}
+	if option.RequestTimeout != 0 {
+		o.RequestTimeout = option.RequestTimeout
+	}
+	o.RateLimit = option.RateLimit
+	o.RateLimitDisconnect = option.RateLimitDisconnect
+	if option.RateLimitWindow != 0 {
+		o.RateLimitWindow = option.RateLimitWindow
+	}
+	o.StringData = option.StringData
+	o.EnableCompression = option.EnableCompression
+	if option.CompressionLevel != nil {
+		o.CompressionLevel = Int(*option.CompressionLevel)
+	}
+	if option.CompressionThreshold != nil {
+		o.CompressionThreshold = Int(*option.CompressionThreshold)
+	}
+	return o
+}
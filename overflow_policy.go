@@ -0,0 +1,33 @@
+package sphere
+
+// OverflowPolicy decides what happens to an outbound message when the connection send queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowPolicyDropOldest discards the oldest queued message to make room for the new one, it is
+	// the default as it never waits for the slow consumer
+	OverflowPolicyDropOldest OverflowPolicy = iota
+	// OverflowPolicyDropNewest discards the new message
+	OverflowPolicyDropNewest
+	// OverflowPolicyBlock waits for room in the queue, then drops the message. A broadcast waits up to
+	// Option.SendTimeout in total, however many of its recipients are slow.
+	OverflowPolicyBlock
+	// OverflowPolicyDisconnect drops the message and disconnects the slow consumer
+	OverflowPolicyDisconnect
+)
+
+// OverflowPolicyCode returns the string value of OverflowPolicy
+var OverflowPolicyCode = [...]string{
+	"dropOldest",
+	"dropNewest",
+	"block",
+	"disconnect",
+}
+
+// Returns the code id of overflow policy
+func (p OverflowPolicy) String() string {
+	if p < 0 || int(p) >= len(OverflowPolicyCode) {
+		return "unknown"
+	}
+	return OverflowPolicyCode[p]
+}
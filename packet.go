@@ -15,7 +15,11 @@ type Packet struct {
 	Error     error      `json:"error,omitempty"`
 	Message   *Message   `json:"message,omitempty"`
 	Reply     bool       `json:"reply"`
-	Machine   string     `json:"-"`
+	Seq       uint64     `json:"seq,omitempty"`
+	Time      int64      `json:"time,omitempty"`
+	ID        string     `json:"id,omitempty"`
+	Except    string     `json:"except,omitempty"`
+	Machine   string     `json:"machine,omitempty"`
 }
 
 // ParsePacket returns Packet from bytes
@@ -43,6 +47,20 @@ func (p *Packet) ToBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// client returns the Packet without the fields only used between nodes, the message data is sent
+// as a json string when stringData is true
+func (p *Packet) client(stringData bool) *Packet {
+	if p.Except == "" && p.Machine == "" && (!stringData || p.Message == nil) {
+		return p
+	}
+	c := *p
+	c.Except, c.Machine = "", ""
+	if stringData && c.Message != nil {
+		c.Message = c.Message.stringify()
+	}
+	return &c
+}
+
 // String returns Packet in string format
 func (p *Packet) String() string {
 	if json, err := p.ToJSON(); err == nil {
@@ -65,8 +83,38 @@ func (p *Packet) MarshalJSON() ([]byte, error) {
 		Error     string     `json:"error,omitempty"`
 		Message   *Message   `json:"message,omitempty"`
 		Reply     bool       `json:"reply"`
-		Machine   string     `json:"-"`
-	}{p.Type, p.Namespace, p.Room, p.Cid, err, p.Message, p.Reply, p.Machine})
+		Seq       uint64     `json:"seq,omitempty"`
+		Time      int64      `json:"time,omitempty"`
+		ID        string     `json:"id,omitempty"`
+		Except    string     `json:"except,omitempty"`
+		Machine   string     `json:"machine,omitempty"`
+	}{p.Type, p.Namespace, p.Room, p.Cid, err, p.Message, p.Reply, p.Seq, p.Time, p.ID, p.Except, p.Machine})
+}
+
+// UnmarshalJSON handler
+func (p *Packet) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Type      PacketType `json:"type"`
+		Namespace string     `json:"namespace,omitempty"`
+		Room      string     `json:"room,omitempty"`
+		Cid       int        `json:"cid"`
+		Error     string     `json:"error,omitempty"`
+		Message   *Message   `json:"message,omitempty"`
+		Reply     bool       `json:"reply"`
+		Seq       uint64     `json:"seq,omitempty"`
+		Time      int64      `json:"time,omitempty"`
+		ID        string     `json:"id,omitempty"`
+		Except    string     `json:"except,omitempty"`
+		Machine   string     `json:"machine,omitempty"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*p = Packet{Type: v.Type, Namespace: v.Namespace, Room: v.Room, Cid: v.Cid, Message: v.Message, Reply: v.Reply, Seq: v.Seq, Time: v.Time, ID: v.ID, Except: v.Except, Machine: v.Machine}
+	if v.Error != "" {
+		p.Error = &Error{v.Error}
+	}
+	return nil
 }
 
 // Response return response packet
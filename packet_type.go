@@ -27,6 +27,19 @@ const (
 	PacketTypePong
 	// PacketTypeUnknown denotes an pong message.
 	PacketTypeUnknown
+
+	// new packet types are appended after PacketTypeUnknown so that the existing values never change
+
+	// PacketTypeDisconnect denotes a request to disconnect the connections of a user.
+	PacketTypeDisconnect
+	// PacketTypePresence denotes a presence query or a presence event.
+	PacketTypePresence
+	// PacketTypeAck denotes the acknowledgement of a channel message.
+	PacketTypeAck
+	// PacketTypeCall denotes a request of the server to a client or its answer.
+	PacketTypeCall
+	// PacketTypeHello denotes the protocol handshake of a client.
+	PacketTypeHello
 )
 
 // PacketTypeCode returns the string value of SphereError
@@ -40,6 +53,11 @@ var PacketTypeCode = [...]string{
 	"ping",
 	"pong",
 	"unknown",
+	"disconnect",
+	"presence",
+	"ack",
+	"call",
+	"hello",
 }
 
 // Returns the error message
@@ -64,8 +82,18 @@ func (p *PacketType) UnmarshalJSON(b []byte) (err error) {
 		*p = PacketTypeUnsubscribed
 	case PacketTypeCode[6]:
 		*p = PacketTypePing
-	case PacketTypeCode[6]:
+	case PacketTypeCode[7]:
 		*p = PacketTypePong
+	case PacketTypeCode[9]:
+		*p = PacketTypeDisconnect
+	case PacketTypeCode[10]:
+		*p = PacketTypePresence
+	case PacketTypeCode[11]:
+		*p = PacketTypeAck
+	case PacketTypeCode[12]:
+		*p = PacketTypeCall
+	case PacketTypeCode[13]:
+		*p = PacketTypeHello
 	default:
 		*p = PacketTypeUnknown
 	}
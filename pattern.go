@@ -0,0 +1,106 @@
+package sphere
+
+import "strings"
+
+// List of pattern wildcards, a room is made of segments separated by slashes
+const (
+	// PatternSegment matches exactly one segment of a room
+	PatternSegment = "+"
+	// PatternSegments matches one or more segments of a room
+	PatternSegments = "*"
+)
+
+// ListenHandler receives the packets published to the rooms a server-side listener is listening to
+type ListenHandler func(*Packet)
+
+// listener is a server-side listener of a channel
+type listener struct {
+	handler ListenHandler
+}
+
+// isPattern checks if the room has a wildcard segment
+func isPattern(room string) bool {
+	for _, segment := range strings.Split(room, "/") {
+		if segment == PatternSegment || segment == PatternSegments {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments checks if the segments of a room match the segments of a pattern
+func matchSegments(pattern []string, room []string) bool {
+	if len(pattern) == 0 {
+		return len(room) == 0
+	}
+	switch pattern[0] {
+	case PatternSegments:
+		for i := 1; i <= len(room); i++ {
+			if matchSegments(pattern[1:], room[i:]) {
+				return true
+			}
+		}
+		return false
+	case PatternSegment:
+		return len(room) > 0 && matchSegments(pattern[1:], room[1:])
+	}
+	return len(room) > 0 && pattern[0] == room[0] && matchSegments(pattern[1:], room[1:])
+}
+
+// globPattern translates a channel pattern into a redis glob, a glob may match more rooms than the
+// pattern so that the messages still have to be matched
+func globPattern(namespace string, room string) string {
+	escape := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	segments := strings.Split(room, "/")
+	for i, segment := range segments {
+		if segment == PatternSegment || segment == PatternSegments {
+			segments[i] = "*"
+		} else {
+			segments[i] = escape.Replace(segment)
+		}
+	}
+	return escape.Replace(namespace+":") + strings.Join(segments, "/")
+}
+
+// Listen calls the handler with every packet published to the room, the room can be a pattern.
+// The handler runs on the broker goroutine and must not block, the returned function stops
+// listening.
+func (sphere *Sphere) Listen(namespace string, room string, handler ListenHandler) (func(), IError) {
+	if namespace == "" || room == "" || handler == nil {
+		return nil, ErrBadScheme
+	}
+	if !sphere.models.Has(namespace) {
+		return nil, ErrNotSupported
+	}
+	channel := sphere.channel(namespace, room, true)
+	if channel == nil {
+		return nil, ErrNotFound
+	}
+	l := &listener{handler}
+	channel.listen(l)
+	if !sphere.broker.IsSubscribed(namespace, room) {
+		c := make(chan IError)
+		go sphere.broker.OnSubscribe(channel, c)
+		if err := <-c; err != nil {
+			channel.unlisten(l)
+			return nil, err
+		}
+	}
+	return func() {
+		channel.unlisten(l)
+		sphere.release(channel)
+	}, nil
+}
+
+// release unsubscribes the channel from the broker once nobody is subscribed or listening to it
+func (sphere *Sphere) release(channel *Channel) IError {
+	if channel.connections.Count() > 0 || channel.listening() {
+		return nil
+	}
+	if sphere.broker.IsSubscribed(channel.namespace, channel.room) {
+		c := make(chan IError)
+		go sphere.broker.OnUnsubscribe(channel, c)
+		return <-c
+	}
+	return nil
+}
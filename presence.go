@@ -0,0 +1,98 @@
+package sphere
+
+import "encoding/json"
+
+// List of presence events
+const (
+	// PresenceMembers is the event of the reply to a presence query
+	PresenceMembers = "members"
+	// PresenceMemberAdded is broadcasted to the room when the first connection of a member subscribes
+	PresenceMemberAdded = "member_added"
+	// PresenceMemberRemoved is broadcasted to the room when the last connection of a member leaves
+	PresenceMemberRemoved = "member_removed"
+)
+
+// IPresence is implemented by channel models that expose who is in a room, the member returned at
+// subscribe time is shown to the other members, a nil member keeps the connection hidden
+type IPresence interface {
+	Presence(string, *Connection) (*Member, IError)
+}
+
+// Member represents a connection in a presence channel
+type Member struct {
+	ID   string `json:"id"`
+	Info string `json:"info,omitempty"`
+}
+
+// join registers the member of the connection and tells the room about its first connection
+func (sphere *Sphere) join(model IChannels, channel *Channel, conn *Connection) IError {
+	// patterns have no members, they only receive the messages of the matching rooms
+	presence, ok := model.(IPresence)
+	if !ok || channel.IsPattern() {
+		return nil
+	}
+	member, err := presence.Presence(channel.room, conn)
+	if err != nil || member == nil {
+		return err
+	}
+	// a connection subscribing again is counted once
+	if !channel.setMember(conn.id, member) {
+		return nil
+	}
+	// the other connections of the member on every node are already announced
+	if n, err := sphere.broker.OnJoin(channel, conn.id, member); err != nil || n > 1 {
+		return err
+	}
+	return sphere.announce(channel, PresenceMemberAdded, member)
+}
+
+// leave removes the member of the connection and tells the room about its last connection
+func (sphere *Sphere) leave(channel *Channel, conn *Connection) IError {
+	member, ok := channel.member(conn.id)
+	if !ok {
+		return nil
+	}
+	channel.removeMember(conn.id)
+	if n, err := sphere.broker.OnLeave(channel, conn.id, member); err != nil || n > 0 {
+		return err
+	}
+	return sphere.announce(channel, PresenceMemberRemoved, member)
+}
+
+// announce publishes a presence event to the room through the broker
+func (sphere *Sphere) announce(channel *Channel, event string, member *Member) IError {
+	data, err := json.Marshal(member)
+	if err != nil {
+		return err
+	}
+	p := &Packet{Type: PacketTypePresence, Namespace: channel.namespace, Room: channel.room, Message: &Message{Event: event, Data: data}, Machine: sphere.broker.ID()}
+	return sphere.broker.OnPublish(channel, p)
+}
+
+// presence replies to a presence query with the members of the room on every node
+func (sphere *Sphere) presence(req *request) IError {
+	p, conn := req.packet, req.conn
+	r := p.Response()
+	channel := sphere.channel(p.Namespace, p.Room)
+	if channel == nil || !channel.isSubscribed(conn) {
+		return ErrNotSubscribed
+	}
+	members, err := sphere.broker.Members(channel)
+	if err != nil {
+		return err
+	}
+	// a user with several connections is listed once
+	list, seen := make([]*Member, 0, len(members)), map[string]bool{}
+	for _, member := range members {
+		if !seen[member.ID] {
+			seen[member.ID] = true
+			list = append(list, member)
+		}
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	r.Message = &Message{Event: PresenceMembers, Data: data}
+	return req.reply(r)
+}
@@ -0,0 +1,209 @@
+package sphere
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// RateLimit is a token bucket limit of the requests received from a connection, zero rates disable
+// the limit and zero bursts default to one second worth of the rate
+type RateLimit struct {
+	// Messages is the number of messages allowed per second
+	Messages float64
+	// MessageBurst is the number of messages allowed at once
+	MessageBurst int
+	// Bytes is the number of bytes allowed per second
+	Bytes float64
+	// ByteBurst is the number of bytes allowed at once
+	ByteBurst int
+}
+
+// IRateLimit is implemented by models that limit the requests of a connection to their namespace,
+// it returns the limit of the namespace and the limit of the given event
+type IRateLimit interface {
+	RateLimit(string) (RateLimit, RateLimit)
+}
+
+// enabled checks if the limit restricts anything
+func (limit RateLimit) enabled() bool {
+	return limit.Messages > 0 || limit.Bytes > 0
+}
+
+// valid checks that the limit has no negative values
+func (limit RateLimit) valid() bool {
+	return limit.Messages >= 0 && limit.MessageBurst >= 0 && limit.Bytes >= 0 && limit.ByteBurst >= 0
+}
+
+// bucket is a token bucket refilled at rate tokens per second up to burst tokens
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+}
+
+// newBucket creates a full bucket, nil when the rate is zero
+func newBucket(rate float64, burst int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	size := float64(burst)
+	if burst <= 0 {
+		size = rate
+	}
+	return &bucket{rate: rate, burst: size, tokens: size}
+}
+
+// refill adds the tokens earned during the elapsed time
+func (b *bucket) refill(elapsed time.Duration) {
+	if b == nil {
+		return
+	}
+	b.tokens += elapsed.Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// has checks if the bucket holds n tokens
+func (b *bucket) has(n float64) bool {
+	return b == nil || b.tokens >= n
+}
+
+// take removes n tokens from the bucket
+func (b *bucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// rejections keeps the times of the last rejected requests of a connection in a ring
+type rejections struct {
+	sync.Mutex
+	times []time.Time
+	// index of the oldest time once the ring is full
+	next int
+}
+
+// add records a rejection and checks if the last max rejections happened within the window
+func (r *rejections) add(now time.Time, max int, window time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+	if len(r.times) < max {
+		r.times = append(r.times, now)
+		return len(r.times) == max && now.Sub(r.times[0]) <= window
+	}
+	r.times[r.next] = now
+	r.next = (r.next + 1) % max
+	return now.Sub(r.times[r.next]) <= window
+}
+
+// limiter enforces a RateLimit on the messages and the bytes of a connection
+type limiter struct {
+	mu       sync.Mutex
+	last     time.Time
+	messages *bucket
+	bytes    *bucket
+}
+
+// newLimiter creates a limiter with full buckets
+func newLimiter(limit RateLimit) *limiter {
+	return &limiter{last: time.Now(), messages: newBucket(limit.Messages, limit.MessageBurst), bytes: newBucket(limit.Bytes, limit.ByteBurst)}
+}
+
+// refill adds the tokens earned since the last request, the caller holds the lock
+func (l *limiter) refill(now time.Time) {
+	l.messages.refill(now.Sub(l.last))
+	l.bytes.refill(now.Sub(l.last))
+	l.last = now
+}
+
+// allow takes one message and size bytes from every limiter, nothing is taken when any bucket runs
+// short. Messages larger than a byte burst can never pass and are rejected as too large. The
+// limiters are locked in the given order.
+func allow(limiters []*limiter, size int) IError {
+	now := time.Now()
+	for _, l := range limiters {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.refill(now)
+	}
+	for _, l := range limiters {
+		if l.bytes != nil && float64(size) > l.bytes.burst {
+			return ErrMessageTooLarge
+		}
+	}
+	for _, l := range limiters {
+		if !l.messages.has(1) || !l.bytes.has(float64(size)) {
+			return ErrTooManyRequest
+		}
+	}
+	for _, l := range limiters {
+		l.messages.take(1)
+		l.bytes.take(float64(size))
+	}
+	return nil
+}
+
+// connectionLimiters is the number of rate limiters a connection keeps, the events coming after
+// share one limiter per namespace so that random event names cannot grow the limiters
+const connectionLimiters = 64
+
+// limit checks the connection, namespace and event limits of a request, the limiters are kept on
+// the connection by level
+func (sphere *Sphere) limit(conn *Connection, p *Packet, size int) IError {
+	type level struct {
+		key   string
+		limit RateLimit
+		// key of the limiter shared by the events once the connection has too many limiters
+		shared string
+	}
+	levels := []level{{"", sphere.option.RateLimit, ""}}
+	// event messages are handled by event models, every other request by channel models
+	var model interface{}
+	prefix := "channel:"
+	if p.Type == PacketTypeMessage {
+		prefix = "event:"
+		if tmp, ok := sphere.events.Get(p.Namespace); ok {
+			model = tmp
+		}
+	} else if tmp, ok := sphere.models.Get(p.Namespace); ok {
+		model = tmp
+	}
+	if limited, ok := model.(IRateLimit); ok {
+		event := ""
+		if p.Message != nil {
+			event = p.Message.Event
+		}
+		namespace, e := limited.RateLimit(event)
+		key := prefix + p.Namespace
+		levels = append(levels, level{key, namespace, ""}, level{key + ":" + event, e, key + ":*"})
+	}
+	limiters := make([]*limiter, 0, len(levels))
+	for _, item := range levels {
+		if !item.limit.enabled() {
+			continue
+		}
+		tmp, ok := conn.limiters.Get(item.key)
+		if !ok && item.shared != "" && conn.limiters.Count() >= connectionLimiters {
+			item.key = item.shared
+			tmp, ok = conn.limiters.Get(item.key)
+		}
+		if !ok {
+			conn.limiters.SetIfAbsent(item.key, newLimiter(item.limit))
+			tmp, _ = conn.limiters.Get(item.key)
+		}
+		limiters = append(limiters, tmp.(*limiter))
+	}
+	return allow(limiters, size)
+}
+
+// throttle counts a rejected request and disconnects the connection once it has been rejected too
+// many times within the rate limit window
+func (sphere *Sphere) throttle(conn *Connection) {
+	if conn.throttled(sphere.option.RateLimitDisconnect, sphere.option.RateLimitWindow) {
+		sphere.failed(conn, ErrTooManyRequest)
+		conn.closeWith(websocket.ClosePolicyViolation, ErrTooManyRequest.Error())
+	}
+}
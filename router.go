@@ -0,0 +1,128 @@
+package sphere
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*Context)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// routable is implemented by the models that route their events to the handlers registered with
+// On, routes returns nil when no handler has been registered
+type routable interface {
+	routes() *router
+}
+
+// router dispatches the events of a model to their handlers
+type router struct {
+	mu       sync.RWMutex
+	handlers map[string]*route
+	fallback *route
+}
+
+// route is an event handler, its payload is decoded from the message data when the handler takes
+// a second argument
+type route struct {
+	fn      reflect.Value
+	payload reflect.Type
+}
+
+// newRoute checks the signature of a handler, it fails when the handler is not a
+// func(*Context) IError or a func(*Context, T) IError
+func newRoute(handler interface{}) (*route, error) {
+	fn := reflect.ValueOf(handler)
+	if !fn.IsValid() {
+		return nil, fmt.Errorf("sphere: handler must be a func(*Context) IError or a func(*Context, T) IError, got nil")
+	}
+	t := fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() < 1 || t.NumIn() > 2 || t.In(0) != contextType || t.NumOut() != 1 || t.Out(0).Kind() != reflect.Interface || !t.Out(0).Implements(errorType) {
+		return nil, fmt.Errorf("sphere: handler must be a func(*Context) IError or a func(*Context, T) IError, got %s", t)
+	}
+	r := &route{fn: fn}
+	if t.NumIn() == 2 {
+		r.payload = t.In(1)
+	}
+	return r, nil
+}
+
+// call decodes the payload of the message and calls the handler
+func (r *route) call(ctx *Context) IError {
+	args := []reflect.Value{reflect.ValueOf(ctx)}
+	if r.payload != nil {
+		t := r.payload
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		v := reflect.New(t)
+		if err := ctx.Decode(v.Interface()); err != nil {
+			return ErrBadScheme
+		}
+		if r.payload.Kind() != reflect.Ptr {
+			v = v.Elem()
+		}
+		args = append(args, v)
+	}
+	if err, ok := r.fn.Call(args)[0].Interface().(IError); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+// on registers the handler of an event
+func (r *router) on(event string, handler interface{}) error {
+	h, err := newRoute(handler)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.handlers == nil {
+		r.handlers = map[string]*route{}
+	}
+	r.handlers[event] = h
+	return nil
+}
+
+// otherwise registers the handler of the events without a handler
+func (r *router) otherwise(handler interface{}) error {
+	h, err := newRoute(handler)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = h
+	return nil
+}
+
+// dispatch calls the handler of the event, ErrNotSupported is returned for unknown events
+func (r *router) dispatch(ctx *Context) IError {
+	r.mu.RLock()
+	h, ok := r.handlers[ctx.Event()]
+	if !ok {
+		h = r.fallback
+	}
+	r.mu.RUnlock()
+	if h == nil {
+		return ErrNotSupported
+	}
+	return h.call(ctx)
+}
+
+// dispatch hands the request to the routes or to the context handler of the model, it returns
+// false when the model only implements Receive
+func (sphere *Sphere) dispatch(model interface{}, req *request) (bool, IError) {
+	if m, ok := model.(routable); ok {
+		if r := m.routes(); r != nil {
+			return true, r.dispatch(sphere.newContext(req))
+		}
+	}
+	if receiver, ok := model.(IContextReceiver); ok {
+		return true, receiver.ReceiveContext(sphere.newContext(req))
+	}
+	return false, nil
+}
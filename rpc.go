@@ -0,0 +1,61 @@
+package sphere
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// request is a packet received from a client, it is answered exactly once
+type request struct {
+	once   sync.Once
+	conn   *Connection
+	packet *Packet
+	// cancelled when the request is answered by a timeout or the connection goes away
+	ctx context.Context
+}
+
+// reply answers the request, answers after the first one are dropped
+func (req *request) reply(r *Packet) IError {
+	var err IError
+	req.once.Do(func() {
+		r.Cid, r.Reply = req.packet.Cid, true
+		err = req.conn.enqueue(websocket.TextMessage, r)
+	})
+	return err
+}
+
+// fail answers the request with an error
+func (req *request) fail(err IError) IError {
+	return req.reply(req.packet.Response().SetError(err))
+}
+
+// serve handles a request and answers it with the error of its handler, or with ErrRequestTimeout
+// when the handler takes longer than the request timeout
+func (sphere *Sphere) serve(req *request) {
+	if sphere.option.RequestTimeout <= 0 {
+		req.ctx = req.conn.Context()
+		if err := sphere.handle(req); err != nil {
+			req.fail(err)
+		}
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.conn.Context(), sphere.option.RequestTimeout)
+	defer cancel()
+	req.ctx = ctx
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := sphere.handle(req); err != nil {
+			req.fail(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			req.fail(ErrRequestTimeout)
+		}
+	}
+}
@@ -1,38 +1,41 @@
 package sphere
 
 import (
+	"context"
+	"io"
 	"net/http"
-	"time"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
+	"github.com/streamrail/concurrent-map"
 )
 
 const (
-	// Read buffer size for websocket upgrader
-	readBufferSize = 1024
-	// Write buffer size for websocker upgrader
-	writeBufferSize = 1024
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// nodeNamespace is the namespace of the broker channels used to reach the connections of a node
+	nodeNamespace = "$node"
+	// userNamespace is the namespace of the broker channels used to reach the connections of a user
+	userNamespace = "$user"
 )
 
-var (
-	// Guid to generate globally unique id
-	guid = xid.New()
-)
+// guid generates a globally unique id
+func guid() string {
+	return xid.New().String()
+}
 
-// Default creates a new instance of Sphere
+// Default creates a new instance of Sphere, it panics when the given Option is invalid
 func Default(opts ...interface{}) *Sphere {
 	// declare agent
 	var broker IBroker
 	var option *Option
+	var authenticator IAuthenticator
+	var store IMessageStore
+	codecs := map[string]ICodec{}
+	for _, codec := range []ICodec{&JSONCodec{}, &MsgPackCodec{}} {
+		codecs[codec.Name()] = codec
+	}
 	// set declared agent if parameter exists
 	for _, i := range opts {
 		switch obj := i.(type) {
@@ -40,27 +43,52 @@ func Default(opts ...interface{}) *Sphere {
 			broker = obj
 		case *Option:
 			option = obj
+		case IAuthenticator:
+			authenticator = obj
+		case IMessageStore:
+			store = obj
+		case ICodec:
+			codecs[obj.Name()] = obj
 		}
 	}
 	if broker == nil {
 		broker = DefaultSimpleBroker()
 	}
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	// fill in default settings and validate
+	config := option.merge()
+	if err := config.Validate(); err != nil {
+		panic(err)
+	}
 	// websocket upgrader
-	upgrader := websocket.Upgrader{ReadBufferSize: readBufferSize, WriteBufferSize: writeBufferSize}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:    config.ReadBufferSize,
+		WriteBufferSize:   config.WriteBufferSize,
+		HandshakeTimeout:  config.HandshakeTimeout,
+		EnableCompression: config.EnableCompression,
+		CheckOrigin:       sameOrigin,
+	}
 	// update websocket upgrader with option object
-	if option != nil {
+	if option != nil && !config.CheckOrigin {
 		upgrader.CheckOrigin = func(r *http.Request) bool {
-			return !option.CheckOrigin
+			return true
 		}
 	}
 	// creates sphere instance
 	sphere := &Sphere{
-		broker:      broker,
-		connections: newConnectionMap(),
-		channels:    newChannelMap(),
-		models:      newChannelModelMap(),
-		events:      newEventModelMap(),
-		upgrader:    upgrader,
+		broker:        broker,
+		connections:   newConnectionMap(),
+		channels:      newChannelMap(),
+		models:        newChannelModelMap(),
+		events:        newEventModelMap(),
+		store:         store,
+		upgrader:      upgrader,
+		option:        config,
+		authenticator: authenticator,
+		codecs:        codecs,
+		sessions:      cmap.New(),
 	}
 	return sphere
 }
@@ -79,46 +107,201 @@ type Sphere struct {
 	events eventmodelmap
 	// websocket upgrader
 	upgrader websocket.Upgrader
-}
-
-// Option for Sphere
-type Option struct {
-	CheckOrigin bool
+	// sphere settings
+	option *Option
+	// handshake authenticator
+	authenticator IAuthenticator
+	// guards closing state
+	mu sync.Mutex
+	// closing is true once Shutdown has been called
+	closing bool
+	// active connection handlers
+	handlers sync.WaitGroup
+	// guards the subscription to the node channel
+	node sync.Mutex
+	// listening is true once the node channel is subscribed
+	listening bool
+	// lifecycle callbacks
+	hooks hooks
+	// guards user channel bindings
+	users sync.Mutex
+	// locks serializing the writes to the message store
+	histories [historyLocks]sync.Mutex
+	// message store keeping the channel history
+	store IMessageStore
+	// messages waiting for an acknowledgement
+	acks acknowledgements
+	// codecs the connections can ask for by name
+	codecs map[string]ICodec
+	// connections carried by the http transports, by session id
+	sessions cmap.ConcurrentMap
 }
 
 // Handler handles and creates websocket connection
 func (sphere *Sphere) Handler(w http.ResponseWriter, r *http.Request) IError {
-	if conn, err := NewConnection(sphere.upgrader, w, r); err == nil {
-		sphere.connections.Set(conn.id, conn)
-		// run connection queue
-		go conn.queue()
-		// action after connection disconnected
-		defer func() {
-			// unsubscribe all channels
-			for item := range conn.channels.Iter() {
-				channel := item.Val
-				sphere.unsubscribe(channel.namespace, channel.room, conn)
-			}
-			// close all send and receive buffers
-			conn.close()
-			// remove connection from sphere after disconnect
-			sphere.connections.Remove(conn.id)
-		}()
-		for {
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				return err
-			}
-			if msg != nil {
-				go sphere.process(conn, msg)
-			}
+	if err := sphere.admit(w); err != nil {
+		return err
+	}
+	defer sphere.handlers.Done()
+	// authenticate before upgrading, rejected requests never become a connection
+	identity, header, err := sphere.authenticate(w, r)
+	if err != nil {
+		return err
+	}
+	hs, err := sphere.negotiate(r, header.Get("Sec-Websocket-Protocol"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	// the subprotocol chosen by the authenticator is kept
+	if hs.subprotocol != "" && header.Get("Sec-Websocket-Protocol") == "" {
+		if header == nil {
+			header = http.Header{}
 		}
-	} else {
+		header.Set("Sec-Websocket-Protocol", hs.subprotocol)
+	}
+	conn, err := NewConnection(sphere.upgrader, sphere.option, w, r, header)
+	if err != nil {
+		return err
+	}
+	conn.codec, conn.version = hs.codec, hs.version
+	conn.SetIdentity(identity)
+	return sphere.run(conn)
+}
+
+// sameOrigin checks that the origin of the request is the host it is sent to, requests without
+// origin are not sent by browsers and are accepted
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// admit registers a connection handler, requests are rejected once the sphere is shutting down or
+// when the node channel cannot be subscribed
+func (sphere *Sphere) admit(w http.ResponseWriter) IError {
+	sphere.mu.Lock()
+	if sphere.closing {
+		sphere.mu.Unlock()
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return ErrServerClosed
+	}
+	sphere.handlers.Add(1)
+	sphere.mu.Unlock()
+	if err := sphere.listen(); err != nil {
+		sphere.handlers.Done()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return err
 	}
 	return nil
 }
 
+// run serves a connection until it goes away, whatever transport carries it
+func (sphere *Sphere) run(conn *Connection) IError {
+	sphere.connections.Set(conn.id, conn)
+	// register connection owner so that other nodes can reach it
+	if err := sphere.broker.OnConnect(conn); err != nil {
+		LogError(err)
+	}
+	// run connection queue
+	go conn.queue()
+	// the error that ended the read loop
+	var rerr error
+	// action after connection disconnected
+	defer func() {
+		// unsubscribe all channels
+		channels := make([]*Channel, 0, conn.channels.Count())
+		for item := range conn.channels.Iter() {
+			channels = append(channels, item.Val)
+		}
+		for _, channel := range channels {
+			sphere.unsubscribe(channel.namespace, channel.room, conn)
+		}
+		sphere.unbind(conn)
+		// close all send and receive buffers
+		conn.close()
+		// keep the unacknowledged messages for the user
+		sphere.park(conn)
+		// remove connection from sphere after disconnect
+		sphere.connections.Remove(conn.id)
+		if err := sphere.broker.OnDisconnect(conn); err != nil {
+			LogError(err)
+		}
+		sphere.disconnected(conn, rerr)
+	}()
+	sphere.connected(conn)
+	// bind connection to its user, the id is set by the authenticator or the connect hooks
+	if id := conn.UserID(); id != "" {
+		sphere.bind(conn, id)
+	}
+	for {
+		_, msg, err := conn.transport.ReadMessage()
+		if err != nil {
+			rerr = err
+			if err == websocket.ErrReadLimit || websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				sphere.failed(conn, err)
+			}
+			return err
+		}
+		if msg != nil {
+			go sphere.process(conn, msg)
+		}
+	}
+}
+
+// Shutdown gracefully stops the sphere. It stops accepting new connections, asks every connection
+// to go away, waits for their handlers to finish and unsubscribes all broker channels. Connections
+// still open when the context expires are closed forcibly and the context error is returned.
+func (sphere *Sphere) Shutdown(ctx context.Context) IError {
+	sphere.mu.Lock()
+	sphere.closing = true
+	sphere.mu.Unlock()
+	// notify clients, the handler defer path runs model Disconnect hooks once they leave
+	for item := range sphere.connections.IterBuffered() {
+		item.Val.closeWith(websocket.CloseGoingAway, "server shutting down")
+	}
+	done := make(chan struct{})
+	go func() {
+		sphere.handlers.Wait()
+		close(done)
+	}()
+	var err IError
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// close remaining sockets so their handlers return
+		for item := range sphere.connections.IterBuffered() {
+			item.Val.close()
+		}
+	}
+	// unsubscribe every channel that is still attached to the broker
+	for item := range sphere.channels.IterBuffered() {
+		channel := item.Val
+		if sphere.broker.IsSubscribed(channel.namespace, channel.room) {
+			c := make(chan IError)
+			go sphere.broker.OnUnsubscribe(channel, c)
+			if e := <-c; e != nil {
+				LogError(e)
+			}
+		}
+		sphere.channels.Remove(item.Key)
+	}
+	// release the message store files
+	if closer, ok := sphere.store.(io.Closer); ok {
+		if e := closer.Close(); e != nil {
+			LogError(e)
+		}
+	}
+	return err
+}
+
 // Models load channel or event models
 func (sphere *Sphere) Models(models ...interface{}) {
 	for _, item := range models {
@@ -135,66 +318,186 @@ func (sphere *Sphere) Models(models ...interface{}) {
 	}
 }
 
+// Publish sends an event to every subscriber of the channel through the broker, so that
+// connections on all nodes sharing the broker receive it. The data is encoded to json, strings are
+// sent as json strings.
+func (sphere *Sphere) Publish(namespace string, room string, event string, data interface{}) IError {
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return err
+	}
+	return sphere.PublishBatch(namespace, room, msg)
+}
+
+// PublishBatch sends a list of messages to the channel in order, nothing is sent if any message is invalid
+func (sphere *Sphere) PublishBatch(namespace string, room string, messages ...*Message) IError {
+	return sphere.broadcast(namespace, room, "", messages...)
+}
+
+// broadcast sends a list of messages to the channel in order, except to the connection with the
+// given id on every node
+func (sphere *Sphere) broadcast(namespace string, room string, except string, messages ...*Message) IError {
+	if namespace == "" || room == "" || isPattern(room) {
+		return ErrBadScheme
+	}
+	if !sphere.models.Has(namespace) {
+		return ErrNotSupported
+	}
+	for _, msg := range messages {
+		if msg == nil || msg.Event == "" {
+			return ErrBadScheme
+		}
+	}
+	// the channel may have no local subscribers, the broker still has to deliver it to other nodes
+	channel := sphere.channel(namespace, room)
+	if channel == nil {
+		channel = NewChannel(namespace, room)
+	}
+	for _, msg := range messages {
+		p := &Packet{Type: PacketTypeChannel, Namespace: namespace, Room: room, Message: msg, Except: except, Machine: sphere.broker.ID()}
+		sphere.identify(p)
+		sphere.record(p)
+		if err := sphere.broker.OnPublish(channel, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendTo sends an event to a single connection, the data is encoded to json. Connections of other
+// nodes are reached through the broker, ErrNotFound is returned when no node owns the connection.
+func (sphere *Sphere) SendTo(id string, event string, data interface{}) IError {
+	if id == "" || event == "" {
+		return ErrBadScheme
+	}
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return err
+	}
+	if conn, ok := sphere.connections.Get(id); ok {
+		return conn.enqueue(websocket.TextMessage, &Packet{Type: PacketTypeMessage, Message: msg})
+	}
+	owner, err := sphere.broker.Owner(id)
+	if err != nil {
+		return err
+	}
+	if owner == "" || owner == sphere.broker.ID() {
+		return ErrNotFound
+	}
+	p := &Packet{Type: PacketTypeMessage, Namespace: nodeNamespace, Room: id, Message: msg, Machine: sphere.broker.ID()}
+	return sphere.broker.OnPublish(NewChannel(nodeNamespace, owner), p)
+}
+
+// listen subscribes to the node channel which receives packets sent to the connections of this
+// node, it is called by the first connection and retried by the next one when it fails
+func (sphere *Sphere) listen() IError {
+	sphere.node.Lock()
+	defer sphere.node.Unlock()
+	if sphere.listening {
+		return nil
+	}
+	channel := NewChannel(nodeNamespace, sphere.broker.ID())
+	channel.handler = func(p *Packet) IError {
+		conn, ok := sphere.connections.Get(p.Room)
+		if !ok {
+			return ErrNotFound
+		}
+		return conn.enqueue(websocket.TextMessage, &Packet{Type: p.Type, Message: p.Message})
+	}
+	sphere.channels.Set(channel.Name(), channel)
+	c := make(chan IError)
+	go sphere.broker.OnSubscribe(channel, c)
+	if err := <-c; err != nil {
+		sphere.channels.Remove(channel.Name())
+		return err
+	}
+	sphere.listening = true
+	return nil
+}
+
 // process parses and processes received message
 func (sphere *Sphere) process(conn *Connection, msg []byte) {
 	// convert received bytes to Packet object
-	p, err := ParsePacket(msg)
+	p, err := conn.codec.Unmarshal(msg)
 	if err != nil {
-		LogError(err)
+		sphere.failed(conn, err)
+		return
+	}
+	// the fields only used between nodes are never set by clients
+	p.Except, p.Machine = "", ""
+	req := &request{conn: conn, packet: p}
+	if err := sphere.limit(conn, p, len(msg)); err != nil {
+		if err == ErrTooManyRequest {
+			sphere.throttle(conn)
+		}
+		if !p.Reply {
+			req.fail(err)
+		}
+		return
+	}
+	// replies answer the calls of the server
+	if p.Reply {
+		conn.resolve(p)
 		return
 	}
+	sphere.serve(req)
+}
+
+// handle processes a request, successful requests are answered by their handler and the returned
+// error is sent back to the client
+func (sphere *Sphere) handle(req *request) IError {
+	p, conn := req.packet, req.conn
 	switch p.Type {
 	case PacketTypeChannel:
-		if p.Namespace != "" && p.Room != "" {
-			// publish message to broker if it is a channel event / message
-			p.Machine = sphere.broker.ID()
-			sphere.publish(p, conn)
-		} else {
-			// if namespace or room is not provided, return error message
-			p.Error = ErrBadScheme
-			conn.send <- p
+		// publish message to broker if it is a channel event / message, patterns only subscribe
+		if p.Namespace == "" || p.Room == "" || isPattern(p.Room) {
+			return ErrBadScheme
 		}
+		p.Machine = sphere.broker.ID()
+		return sphere.publish(req)
 	case PacketTypeSubscribe:
-		if p.Namespace != "" && p.Room != "" {
-			// subscribe connection to channel
-			err := sphere.subscribe(p.Namespace, p.Room, p.Message, conn)
-			r := p.Response()
-			r.SetError(err)
-			// return success or failure message to user
-			conn.send <- r
-		} else {
-			// if namespace or room is not provided, return error message
-			p.Error = ErrBadScheme
-			conn.send <- p
+		// subscribe connection to channel, success is replied by subscribe before any message
+		if p.Namespace == "" || p.Room == "" {
+			return ErrBadScheme
 		}
+		return sphere.subscribe(req)
 	case PacketTypeUnsubscribe:
-		if p.Namespace != "" && p.Room != "" {
-			// unsubscribe connection from channel
-			if sphere.models.Has(p.Namespace) {
-				sphere.unsubscribe(p.Namespace, p.Room, conn)
-			} else {
-				// if namespace model does not existed, return error
-				p.Error = ErrNotSupported
-				conn.send <- p
-			}
-		} else {
-			// if namespace or room is not provided, return error message
-			p.Error = ErrBadScheme
-			conn.send <- p
+		// unsubscribe connection from channel
+		if p.Namespace == "" || p.Room == "" {
+			return ErrBadScheme
+		}
+		if err := sphere.unsubscribe(p.Namespace, p.Room, conn); err != nil {
+			return err
 		}
+		return req.reply(p.Response())
 	case PacketTypeMessage:
-		if p.Namespace != "" {
-			// receive event message
-			sphere.receive(p, conn)
-		} else {
-			p.Error = ErrBadScheme
-			conn.send <- p
+		// receive event message
+		if p.Namespace == "" {
+			return ErrBadScheme
+		}
+		return sphere.receive(req)
+	case PacketTypePresence:
+		// list the members of the channel
+		if p.Namespace == "" || p.Room == "" {
+			return ErrBadScheme
 		}
+		return sphere.presence(req)
+	case PacketTypeAck:
+		// acknowledge a channel message
+		if err := sphere.ack(p, conn); err != nil {
+			return err
+		}
+		return req.reply(p.Response())
+	case PacketTypeHello:
+		return sphere.hello(req)
 	case PacketTypePing:
 		// ping-pong
-		r := p.Response()
-		conn.send <- r
+		return req.reply(p.Response())
+	case PacketTypeUnknown:
+		sphere.failed(conn, ErrPacketBadType)
+		return ErrPacketBadType
 	}
+	return ErrNotSupported
 }
 
 // channel returns Channel object, channel will be automatually created when autoCreateOpts is true
@@ -211,8 +514,14 @@ func (sphere *Sphere) channel(namespace string, room string, autoCreateOpts ...b
 			c <- tmp
 		} else {
 			if autoCreateOpt {
-				channel := NewChannel(namespace, room)
-				sphere.channels.Set(name, channel)
+				created := NewChannel(namespace, room)
+				created.stamp = sphere.stamp(created)
+				if attempts, _ := sphere.acknowledgement(namespace); attempts > 0 {
+					created.handler = sphere.deliver(created)
+				}
+				// another subscriber may have created the channel in the meantime
+				sphere.channels.SetIfAbsent(name, created)
+				channel, _ := sphere.channels.Get(name)
 				c <- channel
 			} else {
 				c <- nil
@@ -222,33 +531,41 @@ func (sphere *Sphere) channel(namespace string, room string, autoCreateOpts ...b
 	return <-c
 }
 
-// subscribe trigger Broker OnSubscribe action and put connection into channel connections list
-func (sphere *Sphere) subscribe(namespace string, room string, message *Message, conn *Connection) IError {
+// subscribe trigger Broker OnSubscribe action and put connection into channel connections list,
+// the connection receives the reply and the missed messages it asked for before any live message
+func (sphere *Sphere) subscribe(req *request) IError {
+	p, conn := req.packet, req.conn
 	var model IChannels
-	if !sphere.models.Has(namespace) {
+	if !sphere.models.Has(p.Namespace) {
 		return ErrNotSupported
 	}
-	if tmp, ok := sphere.models.Get(namespace); ok {
+	if tmp, ok := sphere.models.Get(p.Namespace); ok {
 		model = tmp
 	} else {
 		return ErrNotSupported
 	}
-	if accept, err := model.Subscribe(room, message, conn); !accept && err == nil {
+	if accept, err := model.Subscribe(p.Room, p.Message, conn); !accept && err == nil {
 		return ErrUnauthorized
 	} else if !accept && err != nil {
 		return err
 	}
-	channel := sphere.channel(namespace, room, true)
+	channel := sphere.channel(p.Namespace, p.Room, true)
 	if channel == nil {
 		return ErrNotFound
 	}
-	if err := channel.subscribe(conn); err != nil {
-		return err
-	}
 	if !sphere.broker.IsSubscribed(channel.namespace, channel.room) {
 		c := make(chan IError)
 		go sphere.broker.OnSubscribe(channel, c)
-		return <-c
+		if err := <-c; err != nil {
+			return err
+		}
+	}
+	if err := sphere.replay(req, channel); err != nil {
+		return err
+	}
+	sphere.redeliver(channel, conn)
+	if err := sphere.join(model, channel, conn); err != nil {
+		LogError(err)
 	}
 	return nil
 }
@@ -272,18 +589,18 @@ func (sphere *Sphere) unsubscribe(namespace string, room string, conn *Connectio
 		return ErrNotFound
 	}
 	err := channel.unsubscribe(conn)
-	if err == nil && channel.connections.Count() == 0 {
-		if sphere.broker.IsSubscribed(channel.namespace, channel.room) {
-			c := make(chan IError)
-			go sphere.broker.OnUnsubscribe(channel, c)
-			return <-c
-		}
+	if err == nil {
+		err = sphere.leave(channel, conn)
+	}
+	if err == nil {
+		err = sphere.release(channel)
 	}
 	return err
 }
 
 // publish trigger Broker OnPublish action, send message to user from broker
-func (sphere *Sphere) publish(p *Packet, conn *Connection) IError {
+func (sphere *Sphere) publish(req *request) IError {
+	p, conn := req.packet, req.conn
 	var model IChannels
 	if !sphere.models.Has(p.Namespace) {
 		return ErrNotSupported
@@ -304,22 +621,38 @@ func (sphere *Sphere) publish(p *Packet, conn *Connection) IError {
 	if msg == nil || msg.Event == "" {
 		return ErrBadScheme
 	}
-	res, err := model.Receive(msg.Event, msg.Data)
+	if handled, err := sphere.dispatch(model, req); handled {
+		if err != nil {
+			return err
+		}
+		return req.reply(p.Response())
+	}
+	res, err := model.Receive(msg.Event, msg.Text())
 	if err != nil {
 		return err
 	}
-	d := p.Response()
+	if !sphere.broker.IsSubscribed(channel.namespace, channel.room) {
+		return ErrServerErrors
+	}
+	broadcast := &Message{Event: msg.Event, Data: msg.Data}
 	if res != "" {
-		d.Message.Data = res
+		broadcast, _ = NewMessage(msg.Event, res)
 	}
-	if sphere.broker.IsSubscribed(channel.namespace, channel.room) {
-		return sphere.broker.OnPublish(channel, d)
+	// subscribers get the message as a broadcast, the publisher only gets the reply of its request
+	d := &Packet{Type: PacketTypeChannel, Namespace: p.Namespace, Room: p.Room, Message: broadcast, Except: conn.id, Machine: sphere.broker.ID()}
+	sphere.identify(d)
+	sphere.record(d)
+	if err := sphere.broker.OnPublish(channel, d); err != nil {
+		return err
 	}
-	return ErrServerErrors
+	r := p.Response()
+	r.Message, r.Seq, r.Time, r.ID = broadcast, d.Seq, d.Time, d.ID
+	return req.reply(r)
 }
 
 // receive message and event handler
-func (sphere *Sphere) receive(p *Packet, conn *Connection) IError {
+func (sphere *Sphere) receive(req *request) IError {
+	p := req.packet
 	var model IEvents
 	if !sphere.events.Has(p.Namespace) {
 		return ErrNotSupported
@@ -333,14 +666,19 @@ func (sphere *Sphere) receive(p *Packet, conn *Connection) IError {
 	if msg == nil || msg.Event == "" {
 		return ErrBadScheme
 	}
-	res, err := model.Receive(msg.Event, msg.Data)
+	if handled, err := sphere.dispatch(model, req); handled {
+		if err != nil {
+			return err
+		}
+		return req.reply(p.Response())
+	}
+	res, err := model.Receive(msg.Event, msg.Text())
 	if err != nil {
 		return err
 	}
 	d := p.Response()
 	if res != "" {
-		d.Message.Data = res
+		d.Message, _ = NewMessage(msg.Event, res)
 	}
-	conn.send <- d
-	return nil
+	return req.reply(d)
 }
@@ -1,10 +1,19 @@
 package sphere
 
 import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,13 +27,14 @@ var (
 		defer l.Close()
 		return fmt.Sprintf("127.0.0.1:%d", l.Addr().(*net.TCPAddr).Port)
 	}()
+	server = Default()
 )
 
 type TestSphereModel struct {
 	*ChannelModel
 }
 
-func (m *TestSphereModel) Subscribe(room string, connection *Connection) (bool, IError) {
+func (m *TestSphereModel) Subscribe(room string, message *Message, connection *Connection) (bool, IError) {
 	return true, nil
 }
 
@@ -36,12 +46,68 @@ func (m *TestSphereModel) Receive(event string, message string) (string, IError)
 	return "you_got_me", nil
 }
 
+type TestPresenceModel struct {
+	*ChannelModel
+}
+
+func (m *TestPresenceModel) Subscribe(room string, message *Message, connection *Connection) (bool, IError) {
+	return true, nil
+}
+
+func (m *TestPresenceModel) Presence(room string, connection *Connection) (*Member, IError) {
+	return &Member{ID: connection.UserID(), Info: "online"}, nil
+}
+
+type TestAckModel struct {
+	*TestSphereModel
+	undelivered chan *Packet
+}
+
+func (m *TestAckModel) Undelivered(connection *Connection, p *Packet) {
+	m.undelivered <- p
+}
+
+type TestSlowModel struct {
+	*EventModel
+}
+
+func (m *TestSlowModel) Receive(event string, message string) (string, IError) {
+	if event == "slow" {
+		time.Sleep(200 * time.Millisecond)
+	}
+	return "done", nil
+}
+
+type TestContextModel struct {
+	*ChannelModel
+	waiting   chan struct{}
+	cancelled chan error
+}
+
+func (m *TestContextModel) Subscribe(room string, message *Message, connection *Connection) (bool, IError) {
+	return true, nil
+}
+
+func (m *TestContextModel) ReceiveContext(ctx *Context) IError {
+	switch ctx.Event() {
+	case "chat":
+		return ctx.BroadcastExcept("chat", ctx.Conn.UserID()+": "+ctx.Text())
+	case "whoami":
+		return ctx.Reply(ctx.Conn.UserID() + "@" + ctx.Room)
+	case "wait":
+		m.waiting <- struct{}{}
+		<-ctx.Done()
+		m.cancelled <- ctx.Err()
+	}
+	return nil
+}
+
 func init() {
 	gin.SetMode(gin.ReleaseMode)
-	s, r := Default(), gin.New()
-	s.Models(&TestSphereModel{ExtendChannelModel("test")})
+	r := gin.New()
+	server.Models(&TestSphereModel{ExtendChannelModel("test")})
 	r.GET("/sync", func(c *gin.Context) {
-		s.Handler(c.Writer, c.Request)
+		server.Handler(c.Writer, c.Request)
 	})
 	go r.Run(address)
 }
@@ -164,3 +230,1603 @@ func TestSphereSubscribeChannel(t *testing.T) {
 		t.Fatal(err.Error())
 	}
 }
+
+func TestSpherePublish(t *testing.T) {
+	c, _, err := CreateConnection()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	p := &Packet{Type: PacketTypeSubscribe, Namespace: "test", Room: "publish"}
+	res, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.WriteMessage(websocket.TextMessage, res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := server.PublishBatch("test", "publish", &Message{Event: "a", Data: json.RawMessage(`"1"`)}, &Message{Event: "b", Data: json.RawMessage(`"2"`)}); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, event := range []string{"a", "b"} {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		r, err := ParsePacket(msg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if r.Type != PacketTypeChannel || r.Message == nil || r.Message.Event != event {
+			t.Fatalf("unexpected packet %s", msg)
+		}
+	}
+	if err := server.Publish("unknown", "publish", "a", "1"); err != ErrNotSupported {
+		t.Fatal("publish to unknown namespace should not be supported")
+	}
+}
+
+func TestSphereShutdown(t *testing.T) {
+	s := Default()
+	s.Models(&TestSphereModel{ExtendChannelModel("test")})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	defer ts.Close()
+	u := "ws" + strings.TrimPrefix(ts.URL, "http")
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	p := &Packet{Type: PacketTypeSubscribe, Namespace: "test", Room: "shutdown"}
+	res, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.WriteMessage(websocket.TextMessage, res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := c.ReadMessage(); err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := <-done; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected going away close frame, got %v", err)
+	}
+	if s.connections.Count() != 0 || s.channels.Count() != 0 {
+		t.Fatal("connections and channels should be drained after shutdown")
+	}
+	if s.broker.IsSubscribed("test", "shutdown") {
+		t.Fatal("broker channel should be unsubscribed after shutdown")
+	}
+	if _, r, err := websocket.DefaultDialer.Dial(u, nil); err == nil || r == nil || r.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("upgrade should be rejected after shutdown")
+	}
+}
+
+func TestSphereOptionValidate(t *testing.T) {
+	if err := DefaultOption().Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&Option{PongWait: time.Second}).merge().Validate(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := (&Option{PongWait: time.Second, PingPeriod: time.Minute}).merge().Validate(); err == nil {
+		t.Fatal("ping period greater than pong wait should be rejected")
+	}
+	if err := (&Option{MaxMessageSize: -1}).merge().Validate(); err == nil {
+		t.Fatal("negative max message size should be rejected")
+	}
+	// zero compression settings are kept
+	option := (&Option{CompressionLevel: Int(flate.NoCompression), CompressionThreshold: Int(0)}).merge()
+	if *option.CompressionLevel != flate.NoCompression || *option.CompressionThreshold != 0 {
+		t.Fatalf("unexpected compression settings %d, %d", *option.CompressionLevel, *option.CompressionThreshold)
+	}
+	if err := (&Option{CompressionLevel: Int(10)}).merge().Validate(); err == nil {
+		t.Fatal("unknown compression level should be rejected")
+	}
+}
+
+func TestSphereMaxMessageSize(t *testing.T) {
+	s := Default(&Option{MaxMessageSize: 64})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	p := &Packet{Type: PacketTypeMessage, Namespace: "test", Message: &Message{Event: "big", Data: json.RawMessage(`"` + strings.Repeat("x", 128) + `"`)}}
+	res, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.WriteMessage(websocket.TextMessage, res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected message too big close frame, got %v", err)
+	}
+}
+
+func TestSphereOverflowPolicy(t *testing.T) {
+	create := func(policy OverflowPolicy) *Connection {
+		option := (&Option{SendQueueSize: 2, OverflowPolicy: policy, SendTimeout: 10 * time.Millisecond}).merge()
+		return &Connection{send: make(chan *frame, option.SendQueueSize), done: make(chan struct{}), option: option}
+	}
+	for _, policy := range []OverflowPolicy{OverflowPolicyBlock, OverflowPolicyDropNewest, OverflowPolicyDropOldest} {
+		conn := create(policy)
+		for i := 0; i < 3; i++ {
+			err := conn.enqueue(websocket.TextMessage, []byte{byte(i)})
+			if i < 2 || policy == OverflowPolicyDropOldest {
+				if err != nil {
+					t.Fatalf("%s: unexpected error %v", policy, err)
+				}
+			} else if err != ErrSlowConsumer {
+				t.Fatalf("%s: expected slow consumer error, got %v", policy, err)
+			}
+		}
+		if conn.Dropped() != 1 {
+			t.Fatalf("%s: expected 1 dropped message, got %d", policy, conn.Dropped())
+		}
+		first := (<-conn.send).payload.([]byte)[0]
+		if policy == OverflowPolicyDropOldest && first != 1 {
+			t.Fatalf("%s: oldest message should be dropped", policy)
+		} else if policy != OverflowPolicyDropOldest && first != 0 {
+			t.Fatalf("%s: newest message should be dropped", policy)
+		}
+	}
+	// slow consumers are asked to go away
+	conn := create(OverflowPolicyDisconnect)
+	conn.control = make(chan *frame, controlQueueSize)
+	for i := 0; i < 3; i++ {
+		conn.enqueue(websocket.TextMessage, []byte{byte(i)})
+	}
+	if f := <-conn.control; f.mt != websocket.CloseMessage || conn.Dropped() != 1 {
+		t.Fatalf("%s: expected a close frame, got %v", OverflowPolicyDisconnect, f)
+	}
+	// a broadcast waits for the send timeout once, however many consumers are slow
+	option := (&Option{SendQueueSize: 1, OverflowPolicy: OverflowPolicyBlock, SendTimeout: 100 * time.Millisecond}).merge()
+	var until time.Time
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		conn := &Connection{send: make(chan *frame, 1), done: make(chan struct{}), option: option}
+		conn.send <- &frame{}
+		if err := conn.enqueueUntil(websocket.TextMessage, []byte{0}, &until); err != ErrSlowConsumer {
+			t.Fatalf("expected slow consumer error, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("broadcast should wait for a single send timeout, waited %v", elapsed)
+	}
+	if OverflowPolicy(42).String() != "unknown" {
+		t.Fatal("unknown policies should have a name")
+	}
+}
+
+func TestSphereConcurrentWriters(t *testing.T) {
+	const (
+		clients    = 10
+		publishers = 4
+		published  = 50
+		pings      = 20
+		broadcasts = 5
+	)
+	s := Default(&Option{PingPeriod: 5 * time.Millisecond, PongWait: time.Second})
+	s.Models(&TestSphereModel{ExtendChannelModel("test")})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	defer ts.Close()
+	write := func(c *websocket.Conn, mu *sync.Mutex, p *Packet) {
+		res, err := p.ToJSON()
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := c.WriteMessage(websocket.TextMessage, res); err != nil {
+			t.Error(err.Error())
+		}
+	}
+	conns := make([]*websocket.Conn, clients)
+	locks := make([]*sync.Mutex, clients)
+	for i := range conns {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer c.Close()
+		conns[i], locks[i] = c, &sync.Mutex{}
+		write(c, locks[i], &Packet{Type: PacketTypeSubscribe, Namespace: "test", Room: "stress"})
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	expected := publishers*published + clients*broadcasts
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		wg.Add(2)
+		// read until every broadcast arrived
+		go func(c *websocket.Conn) {
+			defer wg.Done()
+			c.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for received := 0; received < expected; {
+				_, msg, err := c.ReadMessage()
+				if err != nil {
+					t.Error(err.Error())
+					return
+				}
+				if p, err := ParsePacket(msg); err == nil && p.Type == PacketTypeChannel {
+					received++
+				}
+			}
+		}(c)
+		// ping and broadcast from the client while the server publishes
+		go func(c *websocket.Conn, mu *sync.Mutex) {
+			defer wg.Done()
+			for j := 0; j < pings; j++ {
+				write(c, mu, &Packet{Type: PacketTypePing})
+				if j < broadcasts {
+					write(c, mu, &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "stress", Message: &Message{Event: "client"}})
+				}
+			}
+		}(c, locks[i])
+	}
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < published; j++ {
+				if err := s.Publish("test", "stress", "server", "data"); err != nil {
+					t.Error(err.Error())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSphereLifecycleHooks(t *testing.T) {
+	s := Default()
+	connected, disconnected, failed := make(chan *Connection, 1), make(chan int, 1), make(chan IError, 1)
+	s.OnConnect(func(conn *Connection) {
+		connected <- conn
+	})
+	s.OnDisconnect(func(conn *Connection, code int, reason string) {
+		disconnected <- code
+	})
+	s.OnError(func(conn *Connection, err IError) {
+		failed <- err
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	if conn := <-connected; conn == nil {
+		t.Fatal("connect hook should receive the connection")
+	}
+	if err := c.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := <-failed; err != ErrPacketBadScheme {
+		t.Fatalf("expected bad scheme error, got %v", err)
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	if err := c.WriteMessage(websocket.CloseMessage, msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	if code := <-disconnected; code != websocket.CloseNormalClosure {
+		t.Fatalf("expected normal closure, got %d", code)
+	}
+}
+
+func TestSphereAuthenticator(t *testing.T) {
+	auth := AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		if r.URL.Query().Get("token") != "secret" {
+			return nil, NewHandshakeError(http.StatusForbidden, "forbidden")
+		}
+		header.Set("Sec-Websocket-Protocol", "sphere")
+		header.Add("Set-Cookie", "session=1")
+		return "user-1", nil
+	})
+	s := Default(auth)
+	identities := make(chan interface{}, 1)
+	s.OnConnect(func(conn *Connection) {
+		conn.Set("visits", 1)
+		if v, ok := conn.Get("visits"); !ok || v != 1 || conn.UserID() != "user-1" || conn.ID() == "" || conn.RemoteAddr() == nil {
+			identities <- nil
+			return
+		}
+		conn.Delete("visits")
+		if _, ok := conn.Get("visits"); ok {
+			identities <- nil
+			return
+		}
+		identities <- conn.Identity()
+	})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	defer ts.Close()
+	u := "ws" + strings.TrimPrefix(ts.URL, "http")
+	if _, r, err := websocket.DefaultDialer.Dial(u, nil); err == nil || r == nil || r.StatusCode != http.StatusForbidden {
+		t.Fatal("unauthenticated upgrade should be rejected")
+	}
+	// the subprotocol chosen by the authenticator wins over the codec offered before it
+	dialer := websocket.Dialer{Subprotocols: []string{"msgpack", "sphere"}}
+	c, r, err := dialer.Dial(u+"?token=secret", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	if c.Subprotocol() != "sphere" || len(r.Cookies()) != 1 {
+		t.Fatal("authenticator response headers should be sent with the upgrade response")
+	}
+	if identity := <-identities; identity != "user-1" {
+		t.Fatalf("unexpected identity %v", identity)
+	}
+	send(t, c, &Packet{Type: PacketTypePing, Cid: 1})
+	if mt, _, err := c.ReadMessage(); err != nil || mt != websocket.TextMessage {
+		t.Fatalf("the connection should speak json, got %d, %v", mt, err)
+	}
+}
+
+// clusterBroker is a simple broker that publishes to every node of the cluster, like nodes sharing redis
+type clusterBroker struct {
+	*SimpleBroker
+	nodes *[]*clusterBroker
+}
+
+func (broker *clusterBroker) OnPublish(channel *Channel, data *Packet) error {
+	found := false
+	for _, node := range *broker.nodes {
+		err := node.SimpleBroker.OnPublish(channel, data)
+		if err == nil {
+			found = true
+		} else if err != ErrNotFound {
+			return err
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// createCluster returns n spheres connected by a clusterBroker
+func createCluster(n int) []*Sphere {
+	shared := DefaultSimpleBroker()
+	nodes := []*clusterBroker{}
+	spheres := make([]*Sphere, n)
+	for i := range spheres {
+		broker := &clusterBroker{DefaultSimpleBroker(), &nodes}
+		broker.owners, broker.presence = shared.owners, shared.presence
+		nodes = append(nodes, broker)
+		spheres[i] = Default(broker)
+	}
+	return spheres
+}
+
+// serve starts a test server for the sphere and returns its websocket url
+func serve(s *Sphere) (*httptest.Server, string) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Handler(w, r)
+	}))
+	return ts, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestSphereSendTo(t *testing.T) {
+	cluster := createCluster(2)
+	ids := make(chan string, 1)
+	cluster[1].OnConnect(func(conn *Connection) {
+		ids <- conn.ID()
+	})
+	ts, u := serve(cluster[1])
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	id := <-ids
+	for _, s := range cluster {
+		if err := s.SendTo(id, "direct", "hello"); err != nil {
+			t.Fatal(err.Error())
+		}
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		p, err := ParsePacket(msg)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if p.Type != PacketTypeMessage || p.Namespace != "" || p.Message == nil || p.Message.Event != "direct" || p.Message.Text() != "hello" {
+			t.Fatalf("unexpected packet %s", msg)
+		}
+	}
+	if err := cluster[0].SendTo("unknown", "direct", "hello"); err != ErrNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+// failingBroker is a simple broker whose first subscriptions fail, like a broker that is not reachable yet
+type failingBroker struct {
+	*SimpleBroker
+	failures int32
+}
+
+func (broker *failingBroker) OnSubscribe(channel *Channel, done chan<- IError) {
+	if atomic.AddInt32(&broker.failures, -1) >= 0 {
+		done <- ErrServerErrors
+		return
+	}
+	broker.SimpleBroker.OnSubscribe(channel, done)
+}
+
+func TestSphereCheckOrigin(t *testing.T) {
+	for _, check := range []bool{true, false} {
+		s := Default(&Option{CheckOrigin: check})
+		ts, u := serve(s)
+		host := strings.TrimPrefix(ts.URL, "http://")
+		for origin, same := range map[string]bool{"http://" + host: true, "http://example.com": false} {
+			c, res, err := websocket.DefaultDialer.Dial(u, http.Header{"Origin": {origin}})
+			if same || !check {
+				if err != nil {
+					t.Fatalf("expected %s to be accepted, got %v", origin, err)
+				}
+				c.Close()
+			} else if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected %s to be rejected, got %v", origin, err)
+			}
+		}
+		ts.Close()
+	}
+}
+
+func TestSphereNodeSubscription(t *testing.T) {
+	broker := &failingBroker{DefaultSimpleBroker(), 1}
+	s := Default(broker)
+	if broker.IsSubscribed(nodeNamespace, broker.ID()) {
+		t.Fatal("the node channel should not be subscribed before the first connection")
+	}
+	ts, u := serve(s)
+	defer ts.Close()
+	if _, res, err := websocket.DefaultDialer.Dial(u, nil); err == nil || res == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected service unavailable while the broker fails, got %v, %v", res, err)
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	if !broker.IsSubscribed(nodeNamespace, broker.ID()) {
+		t.Fatal("the node channel should be subscribed once a connection is admitted")
+	}
+}
+
+func TestSphereSendToUser(t *testing.T) {
+	auth := AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	})
+	cluster := createCluster(2)
+	conns := []*websocket.Conn{}
+	for _, s := range cluster {
+		s.authenticator = auth
+		ts, u := serve(s)
+		defer ts.Close()
+		for _, user := range []string{"alice", "bob"} {
+			c, _, err := websocket.DefaultDialer.Dial(u+"?user="+user, nil)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			defer c.Close()
+			if user == "alice" {
+				conns = append(conns, c)
+			}
+		}
+	}
+	// wait until every connection is bound
+	for _, s := range cluster {
+		eventually(t, "the connections to be bound", func() bool {
+			return s.connections.Count() == 2 && s.broker.IsSubscribed(userNamespace, "alice")
+		})
+	}
+	if err := cluster[0].SendToUser("alice", "greeting", "hi"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, c := range conns {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if p, err := ParsePacket(msg); err != nil || p.Namespace != "" || p.Message == nil || p.Message.Event != "greeting" {
+			t.Fatalf("unexpected packet %s", msg)
+		}
+	}
+	if err := cluster[1].DisconnectUser("alice"); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, c := range conns {
+		if _, _, err := c.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("expected normal closure, got %v", err)
+		}
+	}
+	for _, s := range cluster {
+		eventually(t, "the user channel to be released", func() bool {
+			return !s.broker.IsSubscribed(userNamespace, "alice")
+		})
+	}
+	if err := cluster[0].SendToUser("alice", "greeting", "hi"); err != ErrNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
+
+// send writes a packet to the websocket connection
+func send(t *testing.T, c *websocket.Conn, p *Packet) {
+	res, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := c.WriteMessage(websocket.TextMessage, res); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// eventually waits until the condition holds, the test fails after 5 seconds
+func eventually(t testing.TB, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expect reads packets until one matches, other packets are skipped
+func expect(t *testing.T, c *websocket.Conn, match func(*Packet) bool) *Packet {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if p, err := ParsePacket(msg); err == nil && match(p) {
+			return p
+		}
+	}
+}
+
+func TestSpherePresence(t *testing.T) {
+	s := Default(AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	}))
+	s.Models(&TestPresenceModel{ExtendChannelModel("presence")})
+	ts, u := serve(s)
+	defer ts.Close()
+	event := func(name string, id string) func(*Packet) bool {
+		return func(p *Packet) bool {
+			return p.Type == PacketTypePresence && p.Message != nil && p.Message.Event == name && strings.Contains(string(p.Message.Data), id)
+		}
+	}
+	conns := map[string]*websocket.Conn{}
+	for _, user := range []string{"alice", "bob"} {
+		c, _, err := websocket.DefaultDialer.Dial(u+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer c.Close()
+		conns[user] = c
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "presence", Room: "lobby"})
+		expect(t, c, event(PresenceMemberAdded, user))
+	}
+	expect(t, conns["alice"], event(PresenceMemberAdded, "bob"))
+	send(t, conns["bob"], &Packet{Type: PacketTypePresence, Namespace: "presence", Room: "lobby"})
+	r := expect(t, conns["bob"], func(p *Packet) bool {
+		return p.Type == PacketTypePresence && p.Reply
+	})
+	var members []*Member
+	if err := json.Unmarshal(r.Message.Data, &members); err != nil || len(members) != 2 {
+		t.Fatalf("expected two members, got %s", r.Message.Data)
+	}
+	// subscribing twice keeps one membership for the connection
+	send(t, conns["bob"], &Packet{Type: PacketTypeSubscribe, Namespace: "presence", Room: "lobby", Cid: 5})
+	expect(t, conns["bob"], func(p *Packet) bool { return p.Reply && p.Cid == 5 })
+	send(t, conns["bob"], &Packet{Type: PacketTypeUnsubscribe, Namespace: "presence", Room: "lobby"})
+	expect(t, conns["alice"], event(PresenceMemberRemoved, "bob"))
+	send(t, conns["alice"], &Packet{Type: PacketTypePresence, Namespace: "presence", Room: "lobby", Cid: 6})
+	r = expect(t, conns["alice"], func(p *Packet) bool { return p.Reply && p.Cid == 6 })
+	if err := json.Unmarshal(r.Message.Data, &members); err != nil || len(members) != 1 || members[0].ID != "alice" {
+		t.Fatalf("expected alice only, got %s", r.Message.Data)
+	}
+}
+
+func TestSpherePresenceConnections(t *testing.T) {
+	auth := AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	})
+	cluster := createCluster(2)
+	urls := []string{}
+	for _, s := range cluster {
+		s.authenticator = auth
+		s.Models(&TestPresenceModel{ExtendChannelModel("presence")})
+		ts, u := serve(s)
+		defer ts.Close()
+		urls = append(urls, u)
+	}
+	dial := func(u string, user string) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(u+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "presence", Room: "lobby"})
+		expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeSubscribed })
+		return c
+	}
+	presence := func(p *Packet) bool { return p.Type == PacketTypePresence }
+	bob := dial(urls[0], "bob")
+	defer bob.Close()
+	expect(t, bob, presence)
+	first := dial(urls[0], "alice")
+	defer first.Close()
+	if r := expect(t, bob, presence); r.Message.Event != PresenceMemberAdded || !strings.Contains(string(r.Message.Data), "alice") {
+		t.Fatalf("expected alice to be added, got %v", r)
+	}
+	// the second connection of alice on another node is not announced, nor is its leave
+	second := dial(urls[1], "alice")
+	second.Close()
+	eventually(t, "the second connection to close", func() bool { return cluster[1].connections.Count() == 0 })
+	first.Close()
+	if r := expect(t, bob, presence); r.Message.Event != PresenceMemberRemoved || !strings.Contains(string(r.Message.Data), "alice") {
+		t.Fatalf("expected alice to be removed, got %v", r)
+	}
+	send(t, bob, &Packet{Type: PacketTypePresence, Namespace: "presence", Room: "lobby"})
+	if r := expect(t, bob, presence); !r.Reply {
+		t.Fatalf("expected a single removal of alice, got %v", r)
+	}
+}
+
+func TestSphereHistoryReplay(t *testing.T) {
+	s := Default()
+	model := &TestSphereModel{ExtendChannelModel("history")}
+	model.SetHistory(2, time.Minute)
+	s.Models(model)
+	ts, u := serve(s)
+	defer ts.Close()
+	for _, event := range []string{"a", "b", "c"} {
+		if err := s.Publish("history", "room", event, ""); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	// the first message has been pushed out of the history
+	send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "history", Room: "room", Seq: 1})
+	if r := expect(t, c, func(p *Packet) bool { return true }); r.Type != PacketTypeSubscribed || r.Error != nil {
+		t.Fatal("subscribe reply should be sent before the replay")
+	}
+	if err := s.Publish("history", "room", "d", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i, event := range []string{"b", "c", "d"} {
+		r := expect(t, c, func(p *Packet) bool { return true })
+		if r.Type != PacketTypeChannel || r.Message.Event != event || r.Seq != uint64(i+2) || r.Time == 0 {
+			t.Fatalf("expected %s with sequence %d, got %v", event, i+2, r)
+		}
+	}
+	if err := s.DeleteHistory("history", "room"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if items, _ := s.store.Range("history:room", 0, 0); len(items) != 0 {
+		t.Fatal("delete history should drop the messages of the room")
+	}
+}
+
+func TestSphereHistoryCluster(t *testing.T) {
+	cluster := createCluster(2)
+	for _, s := range cluster {
+		model := &TestSphereModel{ExtendChannelModel("history")}
+		model.SetHistory(10, time.Minute)
+		s.Models(model)
+	}
+	ts, u := serve(cluster[1])
+	defer ts.Close()
+	dial := func(seq uint64) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "history", Room: "room", Seq: seq, Cid: 1})
+		expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 1 })
+		return c
+	}
+	event := func(p *Packet) bool { return p.Type == PacketTypeChannel }
+	c := dial(0)
+	defer c.Close()
+	// a connection gets the sequences of its node whatever node the messages are published on
+	for i, s := range []*Sphere{cluster[0], cluster[1], cluster[0]} {
+		name := string(rune('a' + i))
+		if err := s.Publish("history", "room", name, ""); err != nil {
+			t.Fatal(err.Error())
+		}
+		if r := expect(t, c, event); r.Message.Event != name || r.Seq != uint64(i+1) {
+			t.Fatalf("expected %s with sequence %d, got %v", name, i+1, r)
+		}
+	}
+	// reconnecting with the last sequence it got replays from the right point
+	again := dial(1)
+	defer again.Close()
+	for i, name := range []string{"b", "c"} {
+		if r := expect(t, again, event); r.Message.Event != name || r.Seq != uint64(i+2) {
+			t.Fatalf("expected %s with sequence %d, got %v", name, i+2, r)
+		}
+	}
+}
+
+func TestSphereAcknowledgement(t *testing.T) {
+	s := Default(AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	}))
+	model := &TestAckModel{&TestSphereModel{ExtendChannelModel("acked")}, make(chan *Packet, 4)}
+	model.SetAcknowledgement(3, 20*time.Millisecond)
+	s.Models(model)
+	ts, u := serve(s)
+	defer ts.Close()
+	dial := func(user string) *websocket.Conn {
+		c, _, err := websocket.DefaultDialer.Dial(u+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "acked", Room: "room"})
+		expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeSubscribed })
+		return c
+	}
+	event := func(name string) func(*Packet) bool {
+		return func(p *Packet) bool {
+			return p.Type == PacketTypeChannel && p.Message != nil && p.Message.Event == name
+		}
+	}
+	c := dial("")
+	defer c.Close()
+	if err := s.Publish("acked", "room", "a", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	first := expect(t, c, event("a"))
+	if first.ID == "" {
+		t.Fatal("acknowledged messages should carry a message id")
+	}
+	// the message is sent again until it is acknowledged
+	if again := expect(t, c, event("a")); again.ID != first.ID {
+		t.Fatal("redelivered message should keep its message id")
+	}
+	send(t, c, &Packet{Type: PacketTypeAck, ID: first.ID, Cid: 7})
+	if r := expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 7 }); r.Error != nil {
+		t.Fatalf("unexpected acknowledgement reply %v", r)
+	}
+	// a message that is never acknowledged is reported once every attempt failed
+	if err := s.Publish("acked", "room", "b", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		expect(t, c, event("b"))
+	}
+	select {
+	case p := <-model.undelivered:
+		if p.Message.Event != "b" {
+			t.Fatalf("expected b to be undelivered, got %s", p.Message.Event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("undelivered message should be reported")
+	}
+	// unacknowledged messages of a user are replayed on its next connection
+	alice := dial("alice")
+	if err := s.Publish("acked", "room", "c", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect(t, alice, event("c"))
+	alice.Close()
+	eventually(t, "alice to disconnect", func() bool { return s.connections.Count() == 1 })
+	alice = dial("alice")
+	defer alice.Close()
+	p := expect(t, alice, event("c"))
+	send(t, alice, &Packet{Type: PacketTypeAck, ID: p.ID})
+}
+
+func TestSphereAcknowledgementTracking(t *testing.T) {
+	s := Default()
+	model := &TestAckModel{&TestSphereModel{ExtendChannelModel("acked")}, make(chan *Packet, 4)}
+	model.SetAcknowledgement(3, time.Hour)
+	s.Models(model)
+	var written int64
+	conn := createChannel(t, 1, &written).Connections()[0]
+	conn.SetIdentity("bob")
+	for _, id := range []string{"a", "b", "c"} {
+		p := &Packet{Type: PacketTypeChannel, Namespace: "acked", Room: "room", ID: id, Message: &Message{Event: id}}
+		pm, err := newEncodings(p).prepare(conn)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		s.track(&pending{conn: conn, packet: p, payload: pm})
+	}
+	// the messages of a connection share one redelivery timer
+	s.acks.Lock()
+	tracked := s.acks.conns[conn.id]
+	s.acks.Unlock()
+	if tracked == nil || len(tracked.items) != 3 || tracked.timer == nil {
+		t.Fatalf("expected three messages on one timer, got %+v", tracked)
+	}
+	// messages tracked after the connection went away are parked instead of leaking an entry
+	conn.close()
+	s.park(conn)
+	p := &Packet{Type: PacketTypeChannel, Namespace: "acked", Room: "room", ID: "d", Message: &Message{Event: "d"}}
+	s.track(&pending{conn: conn, packet: p})
+	s.acks.Lock()
+	defer s.acks.Unlock()
+	if _, ok := s.acks.conns[conn.id]; ok {
+		t.Fatal("a closed connection should not be tracked")
+	}
+	if list := s.acks.users["bob"]; len(list) != 4 || list[0].packet.ID != "a" || list[3].packet.ID != "d" {
+		t.Fatalf("expected the messages to be parked in order, got %d", len(list))
+	}
+}
+
+func TestSphereRequestReply(t *testing.T) {
+	s := Default(&Option{RequestTimeout: 50 * time.Millisecond})
+	s.Models(&TestSphereModel{ExtendChannelModel("rpc")}, &TestSlowModel{ExtendEventModel("rpc")})
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	reply := func(cid int) func(*Packet) bool {
+		return func(p *Packet) bool {
+			return p.Reply && p.Cid == cid
+		}
+	}
+	send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "rpc", Room: "room", Cid: 1})
+	if r := expect(t, c, reply(1)); r.Type != PacketTypeSubscribed || r.Error != nil {
+		t.Fatalf("unexpected subscribe reply %v", r)
+	}
+	// the publisher gets the reply of its request instead of the broadcast
+	send(t, c, &Packet{Type: PacketTypeChannel, Namespace: "rpc", Room: "room", Cid: 2, Message: &Message{Event: "update", Data: json.RawMessage(`"1"`)}})
+	if r := expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeChannel }); !r.Reply || r.Cid != 2 || r.Error != nil || r.Message.Text() != "you_got_me" {
+		t.Fatalf("unexpected packet %v", r)
+	}
+	// handler errors are answered instead of being dropped
+	send(t, c, &Packet{Type: PacketTypeChannel, Namespace: "unknown", Room: "room", Cid: 3, Message: &Message{Event: "update"}})
+	if r := expect(t, c, reply(3)); r.Error == nil || r.Error.Error() != ErrNotSupported.Error() {
+		t.Fatalf("expected not supported error, got %v", r.Error)
+	}
+	// slow handlers are answered once with a timeout
+	send(t, c, &Packet{Type: PacketTypeMessage, Namespace: "rpc", Cid: 4, Message: &Message{Event: "slow"}})
+	if r := expect(t, c, reply(4)); r.Error == nil || r.Error.Error() != ErrRequestTimeout.Error() {
+		t.Fatalf("expected request timeout, got %v", r.Error)
+	}
+	send(t, c, &Packet{Type: PacketTypeMessage, Namespace: "rpc", Cid: 5, Message: &Message{Event: "fast"}})
+	c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+		if r, _ := ParsePacket(msg); r != nil && r.Reply && r.Cid == 4 {
+			t.Fatal("request should be answered once")
+		} else if r != nil && r.Type == PacketTypeChannel {
+			t.Fatal("the publisher should not get the broadcast")
+		}
+	}
+}
+
+func TestConnectionCall(t *testing.T) {
+	s := Default()
+	conns := make(chan *Connection, 1)
+	s.OnConnect(func(conn *Connection) {
+		conns <- conn
+	})
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	conn := <-conns
+	go func() {
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			p, err := ParsePacket(msg)
+			if err != nil || p.Type != PacketTypeCall {
+				continue
+			}
+			r := p.Response()
+			if p.Message.Event == "fail" {
+				r.SetError(ErrNotImplemented)
+			} else {
+				r.Message, _ = NewMessage(p.Message.Event, "answer to "+p.Message.Text())
+			}
+			res, _ := r.ToJSON()
+			c.WriteMessage(websocket.TextMessage, res)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if res, err := conn.Call(ctx, "question", "life"); err != nil || res.Text() != "answer to life" {
+		t.Fatalf("unexpected answer %v, %v", res, err)
+	}
+	if _, err := conn.Call(ctx, "fail", ""); err == nil || err.Error() != ErrNotImplemented.Error() {
+		t.Fatalf("expected not implemented error, got %v", err)
+	}
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	if _, err := conn.Call(expired, "question", "life"); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+// TestLimitedModel limits every event, whatever its name
+type TestLimitedModel struct {
+	*EventModel
+}
+
+func (m *TestLimitedModel) RateLimit(event string) (RateLimit, RateLimit) {
+	return RateLimit{}, RateLimit{Messages: 100}
+}
+
+func TestSphereRateLimitEvents(t *testing.T) {
+	s := Default()
+	s.Models(&TestLimitedModel{ExtendEventModel("limited")})
+	var written int64
+	conn := createChannel(t, 1, &written).Connections()[0]
+	for i := 0; i < 2*connectionLimiters; i++ {
+		p := &Packet{Type: PacketTypeMessage, Namespace: "limited", Message: &Message{Event: fmt.Sprintf("event-%d", i)}}
+		if err := s.limit(conn, p, 10); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the events beyond the cap share one limiter
+	if n := conn.limiters.Count(); n > connectionLimiters+1 {
+		t.Fatalf("expected at most %d limiters, got %d", connectionLimiters+1, n)
+	}
+}
+
+func TestSphereRateLimit(t *testing.T) {
+	s := Default(&Option{RateLimit: RateLimit{Bytes: 1, ByteBurst: 4096}, RateLimitDisconnect: 3})
+	model := &TestSlowModel{ExtendEventModel("limited")}
+	model.SetRateLimit(RateLimit{Messages: 0.001, MessageBurst: 2})
+	model.SetEventRateLimit("rare", RateLimit{Messages: 0.001, MessageBurst: 1})
+	s.Models(model)
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	request := func(cid int, event string) *Packet {
+		send(t, c, &Packet{Type: PacketTypeMessage, Namespace: "limited", Cid: cid, Message: &Message{Event: event}})
+		return expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == cid })
+	}
+	limited := func(r *Packet) bool {
+		return r.Error != nil && r.Error.Error() == ErrTooManyRequest.Error()
+	}
+	// the event limit allows a single rare event, the namespace limit two events
+	if r := request(1, "rare"); r.Error != nil {
+		t.Fatal(r.Error.Error())
+	}
+	if r := request(2, "rare"); !limited(r) {
+		t.Fatalf("expected too many requests, got %v", r.Error)
+	}
+	if r := request(3, "fast"); r.Error != nil {
+		t.Fatal(r.Error.Error())
+	}
+	if r := request(4, "fast"); !limited(r) {
+		t.Fatalf("expected too many requests, got %v", r.Error)
+	}
+	// the third rejected request closes the connection
+	send(t, c, &Packet{Type: PacketTypeMessage, Namespace: "limited", Cid: 5, Message: &Message{Event: "fast"}})
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := c.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Fatalf("expected policy violation, got %v", err)
+			}
+			break
+		}
+	}
+	// the byte limit applies to the whole connection
+	c, _, err = websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	ping := &Packet{Type: PacketTypePing, Cid: 1, Message: &Message{Event: "ping", Data: json.RawMessage(`"` + strings.Repeat("x", 3000) + `"`)}}
+	send(t, c, ping)
+	if r := expect(t, c, func(p *Packet) bool { return p.Reply }); r.Type != PacketTypePong || r.Error != nil {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	send(t, c, ping)
+	if r := expect(t, c, func(p *Packet) bool { return p.Reply }); !limited(r) {
+		t.Fatalf("expected too many requests, got %v", r.Error)
+	}
+	// messages larger than the byte burst could never pass
+	ping.Message.Data = json.RawMessage(`"` + strings.Repeat("x", 5000) + `"`)
+	send(t, c, ping)
+	if r := expect(t, c, func(p *Packet) bool { return p.Reply }); r.Error == nil || r.Error.Error() != ErrMessageTooLarge.Error() {
+		t.Fatalf("expected message too large, got %v", r.Error)
+	}
+	// rejections only close the connection when they happen within the window
+	var r rejections
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if r.add(now.Add(time.Duration(i)*time.Minute), 3, time.Minute) {
+			t.Fatal("rejections spread over time should not close the connection")
+		}
+	}
+	if r.add(now.Add(4*time.Minute+time.Second), 3, time.Minute) || !r.add(now.Add(4*time.Minute+2*time.Second), 3, time.Minute) {
+		t.Fatal("rejections within the window should close the connection")
+	}
+}
+
+func TestSpherePatternSubscribe(t *testing.T) {
+	s := Default()
+	s.Models(&TestSphereModel{ExtendChannelModel("orders")})
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "orders", Room: "region/+/status", Cid: 1})
+	if r := expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 1 }); r.Error != nil {
+		t.Fatal(r.Error.Error())
+	}
+	received := make(chan *Packet, 8)
+	stop, err := s.Listen("orders", "*", func(p *Packet) {
+		received <- p
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, room := range []string{"region/eu/paris/status", "region/eu/status"} {
+		if err := s.Publish("orders", room, "update", room); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// the client only gets the matching room, published under its own name
+	if r := expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeChannel }); r.Room != "region/eu/status" || r.Message.Text() != "region/eu/status" {
+		t.Fatalf("unexpected packet %v", r)
+	}
+	for _, room := range []string{"region/eu/paris/status", "region/eu/status"} {
+		select {
+		case p := <-received:
+			if p.Room != room {
+				t.Fatalf("expected %s, got %s", room, p.Room)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener should receive every room")
+		}
+	}
+	stop()
+	if err := s.Publish("orders", "region/eu/status", "update", ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeChannel })
+	select {
+	case p := <-received:
+		t.Fatalf("stopped listener received %v", p)
+	default:
+	}
+	if err := s.Publish("orders", "region/+/status", "update", ""); err != ErrBadScheme {
+		t.Fatalf("publishing to a pattern should be rejected, got %v", err)
+	}
+}
+
+func TestSphereContextReceiver(t *testing.T) {
+	s := Default(AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+		return r.URL.Query().Get("user"), nil
+	}))
+	model := &TestContextModel{ExtendChannelModel("context"), make(chan struct{}, 1), make(chan error, 1)}
+	s.Models(model)
+	ts, u := serve(s)
+	defer ts.Close()
+	conns := map[string]*websocket.Conn{}
+	for _, user := range []string{"alice", "bob"} {
+		c, _, err := websocket.DefaultDialer.Dial(u+"?user="+user, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer c.Close()
+		conns[user] = c
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "context", Room: "lobby", Cid: 1})
+		expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 1 })
+	}
+	reply := func(cid int) func(*Packet) bool {
+		return func(p *Packet) bool {
+			return p.Reply && p.Cid == cid
+		}
+	}
+	send(t, conns["alice"], &Packet{Type: PacketTypeChannel, Namespace: "context", Room: "lobby", Cid: 2, Message: &Message{Event: "whoami"}})
+	if r := expect(t, conns["alice"], reply(2)); r.Error != nil || r.Message.Text() != "alice@lobby" {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	// the sender gets the reply of its request but not the broadcast
+	send(t, conns["alice"], &Packet{Type: PacketTypeChannel, Namespace: "context", Room: "lobby", Cid: 3, Message: &Message{Event: "chat", Data: json.RawMessage(`"hi"`)}})
+	if r := expect(t, conns["bob"], func(p *Packet) bool { return p.Type == PacketTypeChannel }); r.Message.Text() != "alice: hi" || r.Except != "" {
+		t.Fatalf("unexpected broadcast %v", r)
+	}
+	expect(t, conns["alice"], reply(3))
+	send(t, conns["alice"], &Packet{Type: PacketTypeChannel, Namespace: "context", Room: "lobby", Cid: 4, Message: &Message{Event: "whoami"}})
+	if r := expect(t, conns["alice"], func(p *Packet) bool { return p.Type == PacketTypeChannel }); !r.Reply || r.Cid != 4 {
+		t.Fatalf("sender should not receive its broadcast, got %v", r)
+	}
+	// the context is cancelled when the connection goes away
+	send(t, conns["bob"], &Packet{Type: PacketTypeChannel, Namespace: "context", Room: "lobby", Cid: 2, Message: &Message{Event: "wait"}})
+	<-model.waiting
+	conns["bob"].Close()
+	select {
+	case err := <-model.cancelled:
+		if err != context.Canceled {
+			t.Fatalf("expected cancelled context, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("context should be cancelled on disconnect")
+	}
+}
+
+func TestSphereEventRoutes(t *testing.T) {
+	s := Default()
+	model := ExtendEventModel("routes")
+	model.On("add", func(ctx *Context, in struct{ A, B int }) IError {
+		return ctx.Reply(in.A + in.B)
+	})
+	model.On("hello", func(ctx *Context, in *struct{ Name string }) error {
+		return ctx.Reply("hello " + in.Name)
+	})
+	model.On("ping", func(ctx *Context) IError {
+		return nil
+	})
+	s.Models(model)
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	request := func(cid int, event string, data string) *Packet {
+		send(t, c, &Packet{Type: PacketTypeMessage, Namespace: "routes", Cid: cid, Message: &Message{Event: event, Data: json.RawMessage(data)}})
+		return expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == cid })
+	}
+	if r := request(1, "add", `{"A":1,"B":2}`); r.Error != nil || string(r.Message.Data) != "3" {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	// clients that still encode their payload into a string
+	if r := request(7, "add", `"{\"A\":2,\"B\":3}"`); r.Error != nil || string(r.Message.Data) != "5" {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if r := request(2, "hello", `{"Name":"sphere"}`); r.Error != nil || r.Message.Text() != "hello sphere" {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if r := request(3, "ping", ""); r.Error != nil {
+		t.Fatal(r.Error.Error())
+	}
+	if r := request(4, "add", `"not json"`); r.Error == nil || r.Error.Error() != ErrBadScheme.Error() {
+		t.Fatalf("expected bad scheme error, got %v", r.Error)
+	}
+	if r := request(5, "unknown", ""); r.Error == nil || r.Error.Error() != ErrNotSupported.Error() {
+		t.Fatalf("expected not supported error, got %v", r.Error)
+	}
+	model.Fallback(func(ctx *Context) IError {
+		return ctx.Reply("fallback " + ctx.Event())
+	})
+	if r := request(6, "unknown", ""); r.Error != nil || r.Message.Text() != "fallback unknown" {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if err := model.On("invalid", func(data string) string { return data }); err == nil {
+		t.Fatal("registering an invalid handler should fail")
+	}
+	if err := model.Fallback(nil); err == nil {
+		t.Fatal("registering a nil fallback should fail")
+	}
+	if r := request(8, "unknown", ""); r.Error != nil || r.Message.Text() != "fallback unknown" {
+		t.Fatalf("invalid handlers should keep the registered routes, got %v", r)
+	}
+}
+
+func TestSphereStructuredData(t *testing.T) {
+	type update struct {
+		Items []int
+		Done  bool
+	}
+	for _, stringData := range []bool{false, true} {
+		s := Default(&Option{StringData: stringData}, AuthenticatorFunc(func(r *http.Request, header http.Header) (interface{}, IError) {
+			return "alice", nil
+		}))
+		s.Models(&TestSphereModel{ExtendChannelModel("json")})
+		ts, u := serve(s)
+		c, _, err := websocket.DefaultDialer.Dial(u, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "json", Room: "room", Cid: 1})
+		expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 1 })
+		if err := s.Publish("json", "room", "update", &update{Items: []int{1, 2}, Done: true}); err != nil {
+			t.Fatal(err.Error())
+		}
+		r := expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeChannel })
+		data := `{"Items":[1,2],"Done":true}`
+		if stringData {
+			data = `"{\"Items\":[1,2],\"Done\":true}"`
+		}
+		if string(r.Message.Data) != data {
+			t.Fatalf("unexpected data %s", r.Message.Data)
+		}
+		// string data decodes into the same struct
+		var v update
+		if err := r.Message.Decode(&v); err != nil || len(v.Items) != 2 || !v.Done {
+			t.Fatalf("unexpected decoded data %v, %v", v, err)
+		}
+		// messages sent to a user follow the same data mode
+		eventually(t, "alice to be bound", func() bool { return s.broker.IsSubscribed(userNamespace, "alice") })
+		if err := s.SendToUser("alice", "update", &update{Items: []int{1, 2}, Done: true}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if r := expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeMessage }); string(r.Message.Data) != data {
+			t.Fatalf("unexpected user data %s", r.Message.Data)
+		}
+		c.Close()
+		ts.Close()
+	}
+}
+
+func TestSphereCompression(t *testing.T) {
+	s := Default(&Option{EnableCompression: true, CompressionThreshold: Int(256)})
+	s.Models(&TestSphereModel{ExtendChannelModel("compress")})
+	conns := make(chan *Connection, 2)
+	s.OnConnect(func(conn *Connection) {
+		conns <- conn
+	})
+	ts, u := serve(s)
+	defer ts.Close()
+	for _, compress := range []bool{true, false} {
+		dialer := &websocket.Dialer{EnableCompression: compress}
+		c, _, err := dialer.Dial(u, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer c.Close()
+		conn := <-conns
+		send(t, c, &Packet{Type: PacketTypeSubscribe, Namespace: "compress", Room: "room", Cid: 1})
+		expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == 1 })
+		large := strings.Repeat("sphere ", 200)
+		for _, data := range []string{"small", large} {
+			if err := s.Publish("compress", "room", "update", data); err != nil {
+				t.Fatal(err.Error())
+			}
+			if r := expect(t, c, func(p *Packet) bool { return p.Type == PacketTypeChannel }); r.Message.Text() != data {
+				t.Fatalf("unexpected message %v", r)
+			}
+		}
+		// the stats are updated once the writer returns
+		deadline := time.Now().Add(time.Second)
+		for conn.CompressionStats().Messages == 0 && compress && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		stats := conn.CompressionStats()
+		if compress && (stats.Messages != 1 || stats.Bytes < uint64(len(large)) || stats.Saved() <= 0) {
+			t.Fatalf("expected the large message to be compressed, got %+v", stats)
+		}
+		if !compress && stats != (CompressionStats{}) {
+			t.Fatalf("expected no compressed message, got %+v", stats)
+		}
+	}
+}
+
+func TestSphereHello(t *testing.T) {
+	s := Default(&Option{PingPeriod: 20 * time.Second, PongWait: 30 * time.Second})
+	conns := make(chan *Connection, 1)
+	s.OnConnect(func(conn *Connection) {
+		conns <- conn
+	})
+	ts, u := serve(s)
+	defer ts.Close()
+	c, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	conn := <-conns
+	if conn.Version() != 0 {
+		t.Fatalf("connections without hello should have no version, got %d", conn.Version())
+	}
+	if conn.Conn == nil || conn.Conn.RemoteAddr() == nil {
+		t.Fatal("websocket connections should expose their websocket")
+	}
+	hello := func(c *websocket.Conn, cid int, version int) *Packet {
+		msg, _ := NewMessage("hello", &Hello{Version: version, Capabilities: []string{"binary"}})
+		send(t, c, &Packet{Type: PacketTypeHello, Cid: cid, Message: msg})
+		return expect(t, c, func(p *Packet) bool { return p.Reply && p.Cid == cid })
+	}
+	r := hello(c, 1, ProtocolVersion)
+	var welcome Welcome
+	if err := r.Message.Decode(&welcome); r.Error != nil || err != nil {
+		t.Fatalf("unexpected reply %v, %v", r, err)
+	}
+	if welcome.Version != ProtocolVersion || welcome.ID != conn.ID() || welcome.Heartbeat != 20000 || welcome.Codec != "json" || !reflect.DeepEqual(welcome.Features, []string{FeatureCall}) {
+		t.Fatalf("unexpected welcome %+v", welcome)
+	}
+	// channel features follow the registered models
+	acked := &TestSphereModel{ExtendChannelModel("acked")}
+	acked.SetAcknowledgement(3, time.Second)
+	s.Models(acked, &TestPresenceModel{ExtendChannelModel("presence")})
+	if features := s.features(conn); !reflect.DeepEqual(features, []string{FeatureCall, FeatureAcknowledgement, FeaturePatterns, FeaturePresence}) {
+		t.Fatalf("unexpected features %v", features)
+	}
+	if conn.Version() != ProtocolVersion || !conn.HasCapability("binary") {
+		t.Fatalf("unexpected version %d and capabilities %v", conn.Version(), conn.Capabilities())
+	}
+	if r := hello(c, 2, ProtocolVersion); r.Error == nil || r.Error.Error() != ErrBadStatus.Error() {
+		t.Fatalf("expected bad status error for a second hello, got %v", r.Error)
+	}
+	// unsupported versions are answered with the supported versions and disconnected
+	old, _, err := websocket.DefaultDialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer old.Close()
+	<-conns
+	r = hello(old, 1, ProtocolVersion+1)
+	if err := r.Message.Decode(&welcome); r.Error == nil || r.Error.Error() != ErrBadVersion.Error() || err != nil || welcome.MinVersion != MinProtocolVersion {
+		t.Fatalf("expected unsupported version error, got %v", r)
+	}
+	if _, _, err := old.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("expected protocol error close frame, got %v", err)
+	}
+	// the version can be announced with a subprotocol
+	dialer := &websocket.Dialer{Subprotocols: []string{"sphere.v1"}}
+	versioned, _, err := dialer.Dial(u, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer versioned.Close()
+	if conn := <-conns; versioned.Subprotocol() != "sphere.v1" || conn.Version() != 1 {
+		t.Fatalf("unexpected subprotocol %q", versioned.Subprotocol())
+	}
+	dialer = &websocket.Dialer{Subprotocols: []string{"sphere.v0", "sphere.v99"}}
+	if _, res, err := dialer.Dial(u, nil); err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unsupported versions should be rejected, got %v", err)
+	}
+}
+
+// serveFallback starts a test server for the fallback transports of the sphere
+func serveFallback(s *Sphere) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.FallbackHandler(w, r)
+	}))
+}
+
+// post sends a packet of a fallback session
+func post(t *testing.T, u string, session string, p *Packet) {
+	data, err := p.ToJSON()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := http.Post(u+"?session="+session, "application/json", strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected post status %d", res.StatusCode)
+	}
+}
+
+func TestSphereFallbackOrigin(t *testing.T) {
+	s := Default(&Option{CheckOrigin: true})
+	ts := serveFallback(s)
+	defer ts.Close()
+	for origin, status := range map[string]int{ts.URL: http.StatusOK, "http://example.com": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", ts.URL+"?transport=polling", nil)
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("expected status %d for %s, got %d", status, origin, res.StatusCode)
+		}
+	}
+}
+
+func TestSphereSSE(t *testing.T) {
+	s := Default()
+	s.Models(&TestSphereModel{ExtendChannelModel("test")})
+	conns, disconnected := make(chan *Connection, 1), make(chan int, 1)
+	s.OnConnect(func(conn *Connection) {
+		conns <- conn
+	})
+	s.OnDisconnect(func(conn *Connection, code int, reason string) {
+		disconnected <- code
+	})
+	ts := serveFallback(s)
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "?transport=sse")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", res.Header.Get("Content-Type"))
+	}
+	reader := bufio.NewReader(res.Body)
+	event := func() (string, string) {
+		var name, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && data != "":
+				return name, data
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data += strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}
+	var open struct {
+		Session string `json:"session"`
+	}
+	if name, data := event(); name != "open" || json.Unmarshal([]byte(data), &open) != nil || open.Session == "" {
+		t.Fatalf("unexpected open event %s %s", name, data)
+	}
+	if conn := <-conns; conn.Transport() != TransportSSE || conn.RemoteAddr() == nil {
+		t.Fatalf("unexpected transport %s", conn.Transport())
+	}
+	post(t, ts.URL, open.Session, &Packet{Type: PacketTypeSubscribe, Namespace: "test", Room: "sse", Cid: 1})
+	if _, data := event(); !strings.Contains(data, `"reply":true`) {
+		t.Fatalf("expected subscribe reply, got %s", data)
+	}
+	if err := s.Publish("test", "sse", "a", "1"); err != nil {
+		t.Fatal(err.Error())
+	}
+	_, data := event()
+	if p, err := ParsePacket([]byte(data)); err != nil || p.Type != PacketTypeChannel || p.Message.Event != "a" {
+		t.Fatalf("unexpected packet %s", data)
+	}
+	// binary codecs cannot be streamed
+	if res, err := http.Get(ts.URL + "?transport=sse&codec=msgpack"); err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("binary codecs should be rejected, got %v", err)
+	}
+	res.Body.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the stream should disconnect the session")
+	}
+	if res, err := http.Post(ts.URL+"?session="+open.Session, "application/json", strings.NewReader("{}")); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatalf("closed sessions should be gone, got %v", err)
+	}
+}
+
+func TestSpherePolling(t *testing.T) {
+	s := Default()
+	s.Models(&TestSphereModel{ExtendChannelModel("test")})
+	ts := serveFallback(s)
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "?transport=polling")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var open struct {
+		Session string `json:"session"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&open); err != nil || open.Session == "" {
+		t.Fatalf("unexpected open response %v", err)
+	}
+	res.Body.Close()
+	poll := func() []json.RawMessage {
+		res, err := http.Get(ts.URL + "?session=" + open.Session)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer res.Body.Close()
+		var messages []json.RawMessage
+		if err := json.NewDecoder(res.Body).Decode(&messages); err != nil {
+			t.Fatal(err.Error())
+		}
+		return messages
+	}
+	post(t, ts.URL, open.Session, &Packet{Type: PacketTypeSubscribe, Namespace: "test", Room: "polling", Cid: 1})
+	if messages := poll(); len(messages) != 1 || !strings.Contains(string(messages[0]), `"reply":true`) {
+		t.Fatalf("expected subscribe reply, got %s", messages)
+	}
+	if err := s.PublishBatch("test", "polling", &Message{Event: "a", Data: json.RawMessage(`"1"`)}, &Message{Event: "b", Data: json.RawMessage(`"2"`)}); err != nil {
+		t.Fatal(err.Error())
+	}
+	var events []string
+	for len(events) < 2 {
+		for _, msg := range poll() {
+			p, err := ParsePacket(msg)
+			if err != nil || p.Type != PacketTypeChannel {
+				t.Fatalf("unexpected packet %s", msg)
+			}
+			events = append(events, p.Message.Event)
+		}
+	}
+	if events[0] != "a" || events[1] != "b" {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if res, err := http.Get(ts.URL + "?session=unknown"); err != nil || res.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown sessions should not be found, got %v", err)
+	}
+	if res, err := http.Get(ts.URL + "?transport=carrier-pigeon"); err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unknown transports should be rejected, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("polling sessions should end on shutdown, got %v", err)
+	}
+}
+
+func TestConnectionCloseWith(t *testing.T) {
+	option := (&Option{WriteWait: time.Second}).merge()
+	r := httptest.NewRequest("GET", "/", nil)
+	conn := newConnection(&pollingTransport{httpTransport: newHTTPTransport(TransportPolling, r, 0)}, option, r)
+	for i := 0; i < controlQueueSize; i++ {
+		conn.control <- &frame{}
+	}
+	// the writer is not running, closing must not wait for it
+	start := time.Now()
+	conn.closeWith(websocket.CloseNormalClosure, "")
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("close should not wait for the writer, waited %v", elapsed)
+	}
+	select {
+	case <-conn.done:
+	case <-time.After(time.Second):
+		t.Fatal("connection should be closed")
+	}
+}
@@ -0,0 +1,50 @@
+package sphere
+
+import "time"
+
+// IMessageStore keeps the messages published to channels, sequences are assigned per channel
+type IMessageStore interface {
+	Append(string, *Packet) (uint64, error)       // => Store keeps a copy of the packet, stamped with the next sequence of the channel
+	Range(string, uint64, int) ([]*Packet, error) // => Store packets after the sequence, limit 0 returns all of them
+	Trim(string, int, time.Duration) error        // => Store keeps the newest packets within the count and the age
+	Delete(string) error                          // => Store deletes every packet of the channel
+}
+
+// trimPackets returns the newest packets within the count and the age (zero age keeps all of them)
+func trimPackets(items []*Packet, size int, age time.Duration) []*Packet {
+	if size >= 0 && len(items) > size {
+		items = items[len(items)-size:]
+	}
+	if age > 0 {
+		deadline := time.Now().Add(-age).UnixNano() / int64(time.Millisecond)
+		i := 0
+		for i < len(items) && items[i].Time < deadline {
+			i++
+		}
+		items = items[i:]
+	}
+	return items
+}
+
+// dropPackets clears the first packets of the list so that they can be released while the rest of
+// the list keeps the array, it returns the number of dropped packets
+func dropPackets(items []*Packet, n int) int {
+	for i := 0; i < n; i++ {
+		items[i] = nil
+	}
+	return n
+}
+
+// rangePackets returns the packets after the sequence, limit 0 returns all of them
+func rangePackets(items []*Packet, seq uint64, limit int) []*Packet {
+	list := make([]*Packet, 0, len(items))
+	for _, p := range items {
+		if p.Seq > seq {
+			list = append(list, p)
+			if limit > 0 && len(list) == limit {
+				break
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,264 @@
+package sphere
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// NewFileStore creates a FileStore keeping its files in the directory, the directory is created
+// when it does not exist
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, logs: map[string]*list.Element{}, lru: list.New()}, nil
+}
+
+// fileStoreOpenLogs is the number of channel files a FileStore keeps open
+const fileStoreOpenLogs = 128
+
+// FileStore is a message store keeping one append-only file per channel, so that the history
+// survives restarts. Trimmed messages are dropped from the file once they outnumber the kept ones.
+// Files are only created by Append, and the least recently used ones are closed.
+type FileStore struct {
+	mu   sync.Mutex
+	dir  string
+	logs map[string]*list.Element
+	// loaded logs, the most recently used first
+	lru *list.List
+}
+
+// fileLog is the file and the loaded messages of a channel
+type fileLog struct {
+	channel string
+	seq     uint64
+	items   []*Packet
+	// number of records in the file that have been trimmed
+	dead int
+	file *os.File
+}
+
+// fileRecord is a line of a channel file, a record without packet only carries the sequence
+type fileRecord struct {
+	Seq    uint64          `json:"seq"`
+	Packet json.RawMessage `json:"packet,omitempty"`
+}
+
+// path returns the file of the channel, the name is hex encoded as it may contain any character
+func (store *FileStore) path(channel string) string {
+	return filepath.Join(store.dir, hex.EncodeToString([]byte(channel))+".log")
+}
+
+// open returns the log of the channel, loading its file when it is not loaded. The file is only
+// created when create is set, otherwise a channel without file has no log. The caller holds the lock.
+func (store *FileStore) open(channel string, create bool) (*fileLog, error) {
+	if e, ok := store.logs[channel]; ok {
+		store.lru.MoveToFront(e)
+		return e.Value.(*fileLog), nil
+	}
+	flag := os.O_RDWR | os.O_APPEND
+	if create {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(store.path(channel), flag, 0644)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	log := &fileLog{channel: channel, file: file}
+	reader := bufio.NewReaderSize(file, 64*1024)
+	// offset of the end of the last complete line
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a torn last line is left by a crash while writing, it is cut so that the next record
+			// starts on its own line
+			if len(line) > 0 {
+				if err := file.Truncate(offset); err != nil {
+					file.Close()
+					return nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		offset += int64(len(line))
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			continue
+		}
+		if record.Seq > log.seq {
+			log.seq = record.Seq
+		}
+		if len(record.Packet) == 0 {
+			continue
+		}
+		p, err := ParsePacket(record.Packet)
+		if err != nil {
+			continue
+		}
+		p.Seq = record.Seq
+		log.items = append(log.items, p)
+	}
+	store.logs[channel] = store.lru.PushFront(log)
+	// close the least recently used logs, they are loaded again from their file
+	for store.lru.Len() > fileStoreOpenLogs {
+		e := store.lru.Back()
+		store.release(e.Value.(*fileLog))
+	}
+	return log, nil
+}
+
+// release closes the file of the log and unloads it, the caller holds the lock
+func (store *FileStore) release(log *fileLog) error {
+	if e, ok := store.logs[log.channel]; ok {
+		store.lru.Remove(e)
+		delete(store.logs, log.channel)
+	}
+	return log.file.Close()
+}
+
+// Append keeps a copy of the packet, stamped with the next sequence of the channel
+func (store *FileStore) Append(channel string, p *Packet) (uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	log, err := store.open(channel, true)
+	if err != nil {
+		return 0, err
+	}
+	c := *p
+	c.Seq = log.seq + 1
+	data, err := c.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+	line, err := json.Marshal(&fileRecord{Seq: c.Seq, Packet: data})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := log.file.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	log.seq = c.Seq
+	log.items = append(log.items, &c)
+	p.Seq = c.Seq
+	return c.Seq, nil
+}
+
+// Range returns the packets after the sequence, limit 0 returns all of them
+func (store *FileStore) Range(channel string, seq uint64, limit int) ([]*Packet, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	log, err := store.open(channel, false)
+	if err != nil || log == nil {
+		return nil, err
+	}
+	return rangePackets(log.items, seq, limit), nil
+}
+
+// Trim keeps the newest packets within the count and the age
+func (store *FileStore) Trim(channel string, size int, age time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	log, err := store.open(channel, false)
+	if err != nil || log == nil {
+		return err
+	}
+	items := trimPackets(log.items, size, age)
+	if len(items) == len(log.items) {
+		return nil
+	}
+	log.dead += dropPackets(log.items, len(log.items)-len(items))
+	log.items = items
+	if log.dead > len(log.items) {
+		return store.compact(channel, log)
+	}
+	return nil
+}
+
+// compact rewrites the file of the channel with the kept messages, the last sequence is written
+// first so that it survives when every message has been trimmed. The new file is opened before it
+// replaces the old one, so the log keeps a valid file when the rewrite fails. The caller holds the
+// lock.
+func (store *FileStore) compact(channel string, log *fileLog) error {
+	path := store.path(channel)
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	records := []*fileRecord{{Seq: log.seq}}
+	for _, p := range log.items {
+		data, err := p.ToJSON()
+		if err != nil {
+			return fail(err)
+		}
+		records = append(records, &fileRecord{Seq: p.Seq, Packet: data})
+	}
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fail(err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fail(err)
+	}
+	log.file.Close()
+	// the trimmed packets are released with the old array
+	log.file, log.dead = tmp, 0
+	log.items = append(make([]*Packet, 0, len(log.items)), log.items...)
+	return nil
+}
+
+// Delete deletes every packet of the channel and its file
+func (store *FileStore) Delete(channel string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if e, ok := store.logs[channel]; ok {
+		store.release(e.Value.(*fileLog))
+	}
+	if err := os.Remove(store.path(channel)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close closes the files of the channels, the store must not be used afterwards
+func (store *FileStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var err error
+	for store.lru.Len() > 0 {
+		if e := store.release(store.lru.Front().Value.(*fileLog)); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package sphere
+
+import (
+	"sync"
+	"time"
+)
+
+// NewMemoryStore creates a new instance of MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{logs: map[string]*memoryLog{}}
+}
+
+// MemoryStore is a message store keeping the messages in memory, they are lost on restart
+type MemoryStore struct {
+	mu   sync.RWMutex
+	logs map[string]*memoryLog
+}
+
+// memoryLog is the list of messages of a channel
+type memoryLog struct {
+	seq   uint64
+	items []*Packet
+}
+
+// Append keeps a copy of the packet, stamped with the next sequence of the channel
+func (store *MemoryStore) Append(channel string, p *Packet) (uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	log, ok := store.logs[channel]
+	if !ok {
+		log = &memoryLog{}
+		store.logs[channel] = log
+	}
+	log.seq++
+	p.Seq = log.seq
+	c := *p
+	log.items = append(log.items, &c)
+	return log.seq, nil
+}
+
+// Range returns the packets after the sequence, limit 0 returns all of them
+func (store *MemoryStore) Range(channel string, seq uint64, limit int) ([]*Packet, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if log, ok := store.logs[channel]; ok {
+		return rangePackets(log.items, seq, limit), nil
+	}
+	return nil, nil
+}
+
+// Trim keeps the newest packets within the count and the age
+func (store *MemoryStore) Trim(channel string, size int, age time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if log, ok := store.logs[channel]; ok {
+		// trim in place, appends move the kept packets to a new array once the old one is used up
+		items := trimPackets(log.items, size, age)
+		dropPackets(log.items, len(log.items)-len(items))
+		log.items = items
+	}
+	return nil
+}
+
+// Delete deletes every packet of the channel
+func (store *MemoryStore) Delete(channel string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.logs, channel)
+	return nil
+}
@@ -0,0 +1,174 @@
+package sphere
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// testMessageStore checks the behaviour shared by every message store
+func testMessageStore(t *testing.T, store IMessageStore) {
+	for i := 1; i <= 5; i++ {
+		p := &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "store", Message: &Message{Event: "update", Data: json.RawMessage(`"payload"`)}}
+		seq, err := store.Append("test:store", p)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if seq != uint64(i) || p.Seq != seq {
+			t.Fatalf("expected sequence %d, got %d", i, seq)
+		}
+	}
+	items, err := store.Range("test:store", 2, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(items) != 3 || items[0].Seq != 3 || items[2].Seq != 5 || items[0].Message.Text() != "payload" {
+		t.Fatalf("expected packets 3 to 5, got %d packets", len(items))
+	}
+	if items, _ := store.Range("test:store", 0, 2); len(items) != 2 || items[1].Seq != 2 {
+		t.Fatal("range should stop at the limit")
+	}
+	if err := store.Trim("test:store", 2, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if items, _ := store.Range("test:store", 0, 0); len(items) != 2 || items[0].Seq != 4 {
+		t.Fatal("trim should keep the newest packets")
+	}
+	// sequences keep growing after a trim
+	if seq, _ := store.Append("test:store", &Packet{Type: PacketTypeChannel}); seq != 6 {
+		t.Fatalf("expected sequence 6 after trim, got %d", seq)
+	}
+	old := &Packet{Type: PacketTypeChannel, Time: time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)}
+	store.Append("test:age", old)
+	store.Append("test:age", &Packet{Type: PacketTypeChannel, Time: time.Now().UnixNano() / int64(time.Millisecond)})
+	if err := store.Trim("test:age", 10, time.Minute); err != nil {
+		t.Fatal(err.Error())
+	}
+	if items, _ := store.Range("test:age", 0, 0); len(items) != 1 || items[0].Seq != 2 {
+		t.Fatal("trim should drop the packets older than the age")
+	}
+	if err := store.Delete("test:age"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if items, _ := store.Range("test:age", 0, 0); len(items) != 0 {
+		t.Fatal("delete should remove every packet of the channel")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMessageStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	testMessageStore(t, store)
+}
+
+func TestFileStoreRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 10; i++ {
+		store.Append("test:restart", &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "restart", Message: &Message{Event: "update", Data: json.RawMessage(`"payload"`)}})
+	}
+	// trimming most of the packets compacts the file
+	store.Trim("test:restart", 3, 0)
+	store.Append("test:restart", &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "restart"})
+	store.Close()
+	store, err = NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	items, err := store.Range("test:restart", 0, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(items) != 4 || items[0].Seq != 8 || items[3].Seq != 11 || items[0].Message.Text() != "payload" {
+		t.Fatalf("expected packets 8 to 11 after restart, got %d packets", len(items))
+	}
+	// sequences continue after a restart even when every packet was trimmed
+	store.Trim("test:restart", 0, 0)
+	store.Close()
+	store, _ = NewFileStore(dir)
+	defer store.Close()
+	if seq, _ := store.Append("test:restart", &Packet{Type: PacketTypeChannel}); seq != 12 {
+		t.Fatalf("expected sequence 12 after restart, got %d", seq)
+	}
+}
+
+func TestFileStoreTornLine(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for i := 0; i < 2; i++ {
+		store.Append("test:torn", &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "torn"})
+	}
+	store.Close()
+	// a crash while writing leaves a partial line at the end of the file
+	file, err := os.OpenFile(store.path("test:torn"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.WriteString(`{"seq":3,"packet":{"ty`)
+	file.Close()
+	store, _ = NewFileStore(dir)
+	if seq, err := store.Append("test:torn", &Packet{Type: PacketTypeChannel, Namespace: "test", Room: "torn"}); err != nil || seq != 3 {
+		t.Fatalf("expected sequence 3 after the torn line, got %d, %v", seq, err)
+	}
+	store.Close()
+	store, _ = NewFileStore(dir)
+	defer store.Close()
+	items, err := store.Range("test:torn", 0, 0)
+	if err != nil || len(items) != 3 || items[2].Seq != 3 {
+		t.Fatalf("expected the appended packet to survive a restart, got %d packets, %v", len(items), err)
+	}
+	if seq, _ := store.Append("test:torn", &Packet{Type: PacketTypeChannel}); seq != 4 {
+		t.Fatalf("expected sequence 4, got %d", seq)
+	}
+}
+
+func TestFileStoreOpenLogs(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	// reading or trimming a channel without history creates no file
+	if items, err := store.Range("test:unknown", 1, 0); err != nil || len(items) != 0 {
+		t.Fatalf("unexpected range %v, %v", items, err)
+	}
+	if err := store.Trim("test:unknown", 10, 0); err != nil {
+		t.Fatal(err.Error())
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 || len(store.logs) != 0 {
+		t.Fatalf("expected no file, got %d", len(files))
+	}
+	for i := 0; i < fileStoreOpenLogs+10; i++ {
+		store.Append(fmt.Sprintf("test:%d", i), &Packet{Type: PacketTypeChannel})
+	}
+	if len(store.logs) != fileStoreOpenLogs || store.lru.Len() != fileStoreOpenLogs {
+		t.Fatalf("expected %d open logs, got %d", fileStoreOpenLogs, len(store.logs))
+	}
+	// closed logs are loaded again from their file
+	if items, _ := store.Range("test:0", 0, 0); len(items) != 1 || items[0].Seq != 1 {
+		t.Fatal("closed logs should keep their packets")
+	}
+	if err := store.Delete("test:0"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(store.path("test:0")); !os.IsNotExist(err) {
+		t.Fatal("delete should remove the file of the channel")
+	}
+}
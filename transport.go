@@ -0,0 +1,39 @@
+package sphere
+
+import (
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// List of transports carrying the connections
+const (
+	// TransportWebsocket carries the connection over a websocket
+	TransportWebsocket = "websocket"
+	// TransportSSE streams to the client with Server-Sent Events, the client posts its packets
+	TransportSSE = "sse"
+	// TransportPolling answers the long polls of the client, the client posts its packets
+	TransportPolling = "polling"
+)
+
+// ITransport carries the frames of a connection, the connection reads from a single goroutine and
+// writes from its writer goroutine
+type ITransport interface {
+	Name() string                      // => Transport name
+	ReadMessage() (int, []byte, error) // => Transport reads the next message of the client
+	WriteMessage(int, []byte) error    // => Transport writes a message to the client
+	SetWriteDeadline(time.Time) error  // => Transport deadline of the next writes
+	Close() error                      // => Transport releases the underlying connection
+	RemoteAddr() net.Addr              // => Transport remote network address of the client
+}
+
+// websocketTransport carries the frames of a connection over a websocket
+type websocketTransport struct {
+	*websocket.Conn
+}
+
+// Name returns the name of the transport
+func (t *websocketTransport) Name() string {
+	return TransportWebsocket
+}
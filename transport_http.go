@@ -0,0 +1,466 @@
+package sphere
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionIDSize is the number of random bytes of a session id
+const sessionIDSize = 16
+
+// errSessionExpired is returned by the reader of a session the client stopped polling
+var errSessionExpired = errors.New("session expired")
+
+// httpAddr is the remote address of an http client
+type httpAddr string
+
+// Network returns the name of the network
+func (addr httpAddr) Network() string {
+	return "tcp"
+}
+
+// String returns the address
+func (addr httpAddr) String() string {
+	return string(addr)
+}
+
+// httpTransport receives the messages a client posts with http requests
+type httpTransport struct {
+	name   string
+	remote httpAddr
+	// messages posted by the client
+	in chan []byte
+	// signals a request of the client
+	active chan struct{}
+	// time after which a silent client is gone, zero when the transport notices it by itself
+	idle   time.Duration
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newHTTPTransport creates the upstream part of an http transport
+func newHTTPTransport(name string, r *http.Request, idle time.Duration) *httpTransport {
+	return &httpTransport{
+		name:   name,
+		remote: httpAddr(r.RemoteAddr),
+		in:     make(chan []byte),
+		active: make(chan struct{}, 1),
+		idle:   idle,
+		closed: make(chan struct{}),
+	}
+}
+
+// Name returns the name of the transport
+func (t *httpTransport) Name() string {
+	return t.name
+}
+
+// RemoteAddr returns the remote network address of the client
+func (t *httpTransport) RemoteAddr() net.Addr {
+	return t.remote
+}
+
+// SetWriteDeadline is a no-op, writes are bounded by the http server
+func (t *httpTransport) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// Close ends the session
+func (t *httpTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
+
+// touch records a request of the client
+func (t *httpTransport) touch() {
+	select {
+	case t.active <- struct{}{}:
+	default:
+	}
+}
+
+// ReadMessage returns the next message posted by the client, it fails once the session is closed
+// or the client has been silent for longer than the idle time
+func (t *httpTransport) ReadMessage() (int, []byte, error) {
+	var expired <-chan time.Time
+	var timer *time.Timer
+	if t.idle > 0 {
+		timer = time.NewTimer(t.idle)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case msg := <-t.in:
+			return websocket.TextMessage, msg, nil
+		case <-t.active:
+			if timer != nil {
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(t.idle)
+			}
+		case <-t.closed:
+			return 0, nil, io.EOF
+		case <-expired:
+			return 0, nil, errSessionExpired
+		}
+	}
+}
+
+// push hands a message posted by the client to the reader
+func (t *httpTransport) push(ctx context.Context, msg []byte) IError {
+	t.touch()
+	select {
+	case t.in <- msg:
+		return nil
+	case <-t.closed:
+		return ErrConnectionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sseTransport streams the messages to the client as Server-Sent Events
+type sseTransport struct {
+	*httpTransport
+	// guards the stream, nothing is written once the transport is closed
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// WriteMessage writes a message as an event, pings are comments that keep proxies from closing
+// the stream and a close frame ends the stream with a close event
+func (t *sseTransport) WriteMessage(mt int, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	var err error
+	switch mt {
+	case websocket.TextMessage, websocket.BinaryMessage:
+		err = t.event("", data)
+	case websocket.PingMessage:
+		_, err = io.WriteString(t.w, ": ping\n\n")
+	case websocket.CloseMessage:
+		var close struct {
+			Code   int    `json:"code"`
+			Reason string `json:"reason,omitempty"`
+		}
+		close.Code = websocket.CloseNoStatusReceived
+		if len(data) >= 2 {
+			close.Code, close.Reason = int(binary.BigEndian.Uint16(data)), string(data[2:])
+		}
+		payload, _ := json.Marshal(&close)
+		if err = t.event("close", payload); err == nil {
+			t.flusher.Flush()
+		}
+		t.httpTransport.Close()
+		return err
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t.flusher.Flush()
+	return nil
+}
+
+// event writes an event, every line of the data is a data field
+func (t *sseTransport) event(name string, data []byte) error {
+	var buf bytes.Buffer
+	if name != "" {
+		buf.WriteString("event: " + name + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	_, err := t.w.Write(buf.Bytes())
+	return err
+}
+
+// Close ends the stream, it waits for the write in progress
+func (t *sseTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.httpTransport.Close()
+}
+
+// pollingTransport keeps the messages of the client until it polls them
+type pollingTransport struct {
+	*httpTransport
+	out  chan []byte
+	wait time.Duration
+}
+
+// WriteMessage keeps a message for the next poll, control frames have no equivalent and the client
+// notices a closed session on its next poll
+func (t *pollingTransport) WriteMessage(mt int, data []byte) error {
+	switch mt {
+	case websocket.TextMessage, websocket.BinaryMessage:
+	case websocket.CloseMessage:
+		return t.Close()
+	default:
+		return nil
+	}
+	timer := time.NewTimer(t.wait)
+	defer timer.Stop()
+	select {
+	case t.out <- data:
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	case <-timer.C:
+		// the client stopped polling
+		return ErrSlowConsumer
+	}
+}
+
+// poll waits for the messages of the client, it returns false once the session is closed and
+// every message has been polled
+func (t *pollingTransport) poll(ctx context.Context, timeout time.Duration) ([][]byte, bool) {
+	t.touch()
+	defer t.touch()
+	if messages := t.drain(nil); len(messages) > 0 {
+		return messages, true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-t.out:
+		return t.drain([][]byte{msg}), true
+	case <-t.closed:
+		messages := t.drain(nil)
+		return messages, len(messages) > 0
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return nil, true
+}
+
+// drain appends the waiting messages
+func (t *pollingTransport) drain(messages [][]byte) [][]byte {
+	for {
+		select {
+		case msg := <-t.out:
+			messages = append(messages, msg)
+		default:
+			return messages
+		}
+	}
+}
+
+// sessionID returns an unguessable session id, unlike the connection id it is a secret shared with
+// the client
+func sessionID() (string, error) {
+	b := make([]byte, sessionIDSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// FallbackHandler serves the clients that cannot open a websocket. A GET request with
+// ?transport=sse opens a Server-Sent Events stream whose first event carries the session id, a GET
+// request with ?transport=polling opens a long-polling session and answers with its id. The client
+// then posts its packets with POST requests carrying ?session=<id>, and long-polling clients poll
+// their messages with GET requests carrying ?session=<id>.
+func (sphere *Sphere) FallbackHandler(w http.ResponseWriter, r *http.Request) IError {
+	// the origin policy of the websocket handler applies to the http transports too
+	if !sphere.upgrader.CheckOrigin(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return ErrUnauthorized
+	}
+	query := r.URL.Query()
+	id := query.Get("session")
+	switch {
+	case id == "" && r.Method == "GET":
+		return sphere.open(w, r, query.Get("transport"))
+	case id != "" && r.Method == "GET":
+		return sphere.poll(w, r, id)
+	case id != "" && r.Method == "POST":
+		return sphere.post(w, r, id)
+	}
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return ErrBadRequestMethod
+}
+
+// open creates a session carried by an http transport and serves it
+func (sphere *Sphere) open(w http.ResponseWriter, r *http.Request, name string) IError {
+	var flusher http.Flusher
+	switch name {
+	case TransportSSE:
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, ErrNotSupported.Error(), http.StatusInternalServerError)
+			return ErrNotSupported
+		}
+		flusher = f
+	case TransportPolling:
+	default:
+		http.Error(w, ErrNotSupported.Error(), http.StatusBadRequest)
+		return ErrNotSupported
+	}
+	if err := sphere.admit(w); err != nil {
+		return err
+	}
+	identity, header, err := sphere.authenticate(w, r)
+	if err != nil {
+		sphere.handlers.Done()
+		return err
+	}
+	hs, err := sphere.negotiate(r, header.Get("Sec-Websocket-Protocol"))
+	// the frames of http transports are text
+	if err == nil && hs.codec.MessageType() != websocket.TextMessage {
+		err = ErrNotSupported
+	}
+	if err != nil {
+		sphere.handlers.Done()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	session, e := sessionID()
+	if e != nil {
+		sphere.handlers.Done()
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return e
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	open, _ := json.Marshal(map[string]string{"session": session})
+	if name == TransportPolling {
+		t := &pollingTransport{newHTTPTransport(name, r, sphere.option.PongWait), make(chan []byte, sphere.option.SendQueueSize), sphere.option.WriteWait}
+		conn := sphere.session(t, r, hs, identity, session)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(open)
+		go func() {
+			defer sphere.handlers.Done()
+			defer sphere.sessions.Remove(session)
+			sphere.run(conn)
+		}()
+		return nil
+	}
+	defer sphere.handlers.Done()
+	defer sphere.sessions.Remove(session)
+	t := &sseTransport{httpTransport: newHTTPTransport(name, r, 0), w: w, flusher: flusher}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := t.event("open", open); err != nil {
+		return err
+	}
+	flusher.Flush()
+	conn := sphere.session(t, r, hs, identity, session)
+	// the stream ends when the client goes away
+	go func() {
+		select {
+		case <-r.Context().Done():
+			t.Close()
+		case <-t.closed:
+		}
+	}()
+	return sphere.run(conn)
+}
+
+// session creates the connection of a session
+func (sphere *Sphere) session(t ITransport, r *http.Request, hs *handshake, identity interface{}, session string) *Connection {
+	conn := newConnection(t, sphere.option, r)
+	conn.codec, conn.version = hs.codec, hs.version
+	conn.SetIdentity(identity)
+	sphere.sessions.Set(session, conn)
+	return conn
+}
+
+// lookup returns the connection of a session, unknown sessions are answered with not found
+func (sphere *Sphere) lookup(w http.ResponseWriter, session string) (*Connection, IError) {
+	tmp, ok := sphere.sessions.Get(session)
+	if !ok {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return nil, ErrNotFound
+	}
+	return tmp.(*Connection), nil
+}
+
+// poll answers a long poll with a json array of the messages of the session
+func (sphere *Sphere) poll(w http.ResponseWriter, r *http.Request, session string) IError {
+	conn, err := sphere.lookup(w, session)
+	if err != nil {
+		return err
+	}
+	t, ok := conn.transport.(*pollingTransport)
+	if !ok {
+		http.Error(w, ErrNotSupported.Error(), http.StatusBadRequest)
+		return ErrNotSupported
+	}
+	messages, ok := t.poll(r.Context(), sphere.option.PingPeriod)
+	if !ok {
+		http.Error(w, ErrConnectionClosed.Error(), http.StatusGone)
+		return ErrConnectionClosed
+	}
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i, msg := range messages {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		// raw messages emitted to the channels may not be json
+		if !json.Valid(msg) {
+			msg, _ = json.Marshal(string(msg))
+		}
+		buf.Write(msg)
+	}
+	buf.WriteString("]")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+	return nil
+}
+
+// post hands the packet posted by the client to its session
+func (sphere *Sphere) post(w http.ResponseWriter, r *http.Request, session string) IError {
+	conn, err := sphere.lookup(w, session)
+	if err != nil {
+		return err
+	}
+	t, ok := conn.transport.(interface {
+		push(context.Context, []byte) IError
+	})
+	if !ok {
+		http.Error(w, ErrNotSupported.Error(), http.StatusBadRequest)
+		return ErrNotSupported
+	}
+	body, e := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, sphere.option.MaxMessageSize))
+	if e != nil {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return e
+	}
+	if err := t.push(r.Context(), body); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
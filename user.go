@@ -0,0 +1,96 @@
+package sphere
+
+import "github.com/gorilla/websocket"
+
+// BindUser binds the connection to a user, so that it is reached by SendToUser and DisconnectUser
+func (sphere *Sphere) BindUser(conn *Connection, id string) {
+	sphere.unbind(conn)
+	conn.SetUserID(id)
+	if id != "" {
+		sphere.bind(conn, id)
+	}
+}
+
+// SendToUser sends an event to every connection of the user on every node, the data is encoded to
+// json. ErrNotFound is returned when the user has no connection.
+func (sphere *Sphere) SendToUser(id string, event string, data interface{}) IError {
+	if id == "" || event == "" {
+		return ErrBadScheme
+	}
+	msg, err := NewMessage(event, data)
+	if err != nil {
+		return err
+	}
+	p := &Packet{Type: PacketTypeMessage, Namespace: userNamespace, Room: id, Message: msg, Machine: sphere.broker.ID()}
+	return sphere.broker.OnPublish(NewChannel(userNamespace, id), p)
+}
+
+// DisconnectUser closes every connection of the user on every node, ErrNotFound is returned when
+// the user has no connection
+func (sphere *Sphere) DisconnectUser(id string) IError {
+	if id == "" {
+		return ErrBadScheme
+	}
+	p := &Packet{Type: PacketTypeDisconnect, Namespace: userNamespace, Room: id, Machine: sphere.broker.ID()}
+	return sphere.broker.OnPublish(NewChannel(userNamespace, id), p)
+}
+
+// bind adds the connection to the user channel, the broker channel is subscribed for the first
+// connection of the user on this node
+func (sphere *Sphere) bind(conn *Connection, id string) {
+	sphere.users.Lock()
+	defer sphere.users.Unlock()
+	name := sphere.broker.ChannelName(userNamespace, id)
+	channel, ok := sphere.channels.Get(name)
+	if !ok {
+		channel = NewChannel(userNamespace, id)
+		channel.handler = func(p *Packet) IError {
+			if p.Type == PacketTypeDisconnect {
+				for _, c := range channel.Connections() {
+					c.closeWith(websocket.CloseNormalClosure, "disconnected")
+				}
+				return nil
+			}
+			// every connection gets the packet in its codec and data mode
+			return channel.deliver(&Packet{Type: p.Type, Message: p.Message}, func(*Connection) bool { return false })
+		}
+		sphere.channels.Set(name, channel)
+	}
+	channel.connections.Set(conn.id, conn)
+	conn.bound = id
+	if !sphere.broker.IsSubscribed(userNamespace, id) {
+		c := make(chan IError)
+		go sphere.broker.OnSubscribe(channel, c)
+		if err := <-c; err != nil {
+			LogError(err)
+		}
+	}
+}
+
+// unbind removes the connection from its user channel, the broker channel is unsubscribed when
+// the user has no connection left on this node
+func (sphere *Sphere) unbind(conn *Connection) {
+	sphere.users.Lock()
+	defer sphere.users.Unlock()
+	if conn.bound == "" {
+		return
+	}
+	name := sphere.broker.ChannelName(userNamespace, conn.bound)
+	conn.bound = ""
+	channel, ok := sphere.channels.Get(name)
+	if !ok {
+		return
+	}
+	channel.connections.Remove(conn.id)
+	if channel.connections.Count() > 0 {
+		return
+	}
+	sphere.channels.Remove(name)
+	if sphere.broker.IsSubscribed(channel.namespace, channel.room) {
+		c := make(chan IError)
+		go sphere.broker.OnUnsubscribe(channel, c)
+		if err := <-c; err != nil {
+			LogError(err)
+		}
+	}
+}